@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+const (
+	podIPIndex       = "podIP"
+	clusterIPIndex   = "clusterIP"
+	serviceNameIndex = "serviceName"
+	endpointIPIndex  = "endpointIP"
+)
+
+// clusterCache keeps the pods, services and EndpointSlices of the cluster in
+// memory, indexed by pod IP and cluster IP, so destinations are looked up
+// without calls to the apiserver.
+type clusterCache struct {
+	factory   informers.SharedInformerFactory
+	pods      cache.SharedIndexInformer
+	services  cache.SharedIndexInformer
+	slices    cache.SharedIndexInformer
+	podLister corelisters.PodLister
+}
+
+func newClusterCache(client kubernetes.Interface) *clusterCache {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithTransform(stripManagedFields))
+	c := &clusterCache{
+		factory:   factory,
+		pods:      factory.Core().V1().Pods().Informer(),
+		services:  factory.Core().V1().Services().Informer(),
+		slices:    factory.Discovery().V1().EndpointSlices().Informer(),
+		podLister: factory.Core().V1().Pods().Lister(),
+	}
+	c.pods.AddIndexers(cache.Indexers{podIPIndex: podIPKeys})
+	c.services.AddIndexers(cache.Indexers{clusterIPIndex: clusterIPKeys})
+	c.slices.AddIndexers(cache.Indexers{serviceNameIndex: sliceServiceKeys, endpointIPIndex: sliceEndpointIPKeys})
+	return c
+}
+
+// cacheSyncTimeout bounds the wait for the first list of the cache, replaced
+// in tests.
+var cacheSyncTimeout = 2 * time.Minute
+
+// start runs the informers until ctx is done and waits for their first list.
+// It gives up when a list is denied, since the informers retry those
+// forever, or after cacheSyncTimeout.
+func (c *clusterCache) start(ctx context.Context) error {
+	syncCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	for resource, informer := range map[string]cache.SharedIndexInformer{
+		"pods":           c.pods,
+		"services":       c.services,
+		"endpointslices": c.slices,
+	} {
+		err := informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+			cache.DefaultWatchErrorHandler(r, err)
+			if apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) {
+				cancel(fmt.Errorf("cannot list and watch %s in all namespaces: %w", resource, err))
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.factory.Start(ctx.Done())
+	timer := time.AfterFunc(cacheSyncTimeout, func() {
+		cancel(fmt.Errorf("timed out after %s", cacheSyncTimeout))
+	})
+	defer timer.Stop()
+	for typ, synced := range c.factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return fmt.Errorf("%v not synced: %w", typ, context.Cause(syncCtx))
+		}
+	}
+	return nil
+}
+
+// onServiceChange calls fn with the cluster IPs of every service that
+// changed, or whose EndpointSlices changed. It must be set before start.
+func (c *clusterCache) onServiceChange(fn func(ips []string)) {
+	changed := func(objs ...any) {
+		var ips []string
+		for _, obj := range objs {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			switch obj := obj.(type) {
+			case *v1.Service:
+				keys, _ := clusterIPKeys(obj)
+				ips = append(ips, keys...)
+			case *discoveryv1.EndpointSlice:
+				if svc := c.service(obj.Namespace, obj.Labels[discoveryv1.LabelServiceName]); svc != nil {
+					keys, _ := clusterIPKeys(svc)
+					ips = append(ips, keys...)
+				}
+			}
+		}
+		if len(ips) > 0 {
+			fn(ips)
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { changed(obj) },
+		UpdateFunc: func(old, cur any) { changed(old, cur) },
+		DeleteFunc: func(obj any) { changed(obj) },
+	}
+	c.services.AddEventHandler(handler)
+	c.slices.AddEventHandler(handler)
+}
+
+// onPodChange calls fn with every pod added, updated or deleted, and whether
+// it was deleted. Set after start, fn first gets the cached pods as added.
+func (c *clusterCache) onPodChange(fn func(pod *v1.Pod, deleted bool)) {
+	changed := func(obj any, deleted bool) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if pod, ok := obj.(*v1.Pod); ok {
+			fn(pod, deleted)
+		}
+	}
+	c.pods.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { changed(obj, false) },
+		UpdateFunc: func(_, cur any) { changed(cur, false) },
+		DeleteFunc: func(obj any) { changed(obj, true) },
+	})
+}
+
+// podByIP returns the running pod with ip, or nil. Pods that exited may still
+// hold an IP that was handed to a new pod, so only running ones count.
+func (c *clusterCache) podByIP(ip string) *v1.Pod {
+	objs, err := c.pods.GetIndexer().ByIndex(podIPIndex, normalizeIP(ip))
+	if err != nil {
+		klog.Errorf("failed to look up pod %s: %v", ip, err)
+		return nil
+	}
+	for _, obj := range objs {
+		pod := obj.(*v1.Pod)
+		if pod.Status.Phase == v1.PodRunning && pod.DeletionTimestamp == nil {
+			return pod
+		}
+	}
+	return nil
+}
+
+// serviceByIP returns the service with cluster IP ip, or nil.
+func (c *clusterCache) serviceByIP(ip string) *v1.Service {
+	objs, err := c.services.GetIndexer().ByIndex(clusterIPIndex, normalizeIP(ip))
+	if err != nil {
+		klog.Errorf("failed to look up service %s: %v", ip, err)
+		return nil
+	}
+	if len(objs) == 0 {
+		return nil
+	}
+	return objs[0].(*v1.Service)
+}
+
+// serviceSlices returns the EndpointSlices of svc.
+func (c *clusterCache) serviceSlices(svc *v1.Service) []*discoveryv1.EndpointSlice {
+	objs, err := c.slices.GetIndexer().ByIndex(serviceNameIndex, svc.Namespace+"/"+svc.Name)
+	if err != nil {
+		klog.Errorf("failed to look up endpoint slices of %s/%s: %v", svc.Namespace, svc.Name, err)
+		return nil
+	}
+	slices := make([]*discoveryv1.EndpointSlice, 0, len(objs))
+	for _, obj := range objs {
+		slices = append(slices, obj.(*discoveryv1.EndpointSlice))
+	}
+	return slices
+}
+
+// service returns the service namespace/name, or nil.
+func (c *clusterCache) service(namespace, name string) *v1.Service {
+	obj, ok, err := c.services.GetIndexer().GetByKey(namespace + "/" + name)
+	if err != nil || !ok {
+		return nil
+	}
+	return obj.(*v1.Service)
+}
+
+// hasNamespace reports whether any service or pod lives in namespace.
+func (c *clusterCache) hasNamespace(namespace string) bool {
+	for _, informer := range []cache.SharedIndexInformer{c.services, c.pods} {
+		if keys, err := informer.GetIndexer().IndexKeys(cache.NamespaceIndex, namespace); err == nil && len(keys) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// slicesByEndpointIP returns the EndpointSlices with an endpoint at ip.
+func (c *clusterCache) slicesByEndpointIP(ip string) []*discoveryv1.EndpointSlice {
+	objs, err := c.slices.GetIndexer().ByIndex(endpointIPIndex, normalizeIP(ip))
+	if err != nil {
+		klog.Errorf("failed to look up endpoint slices of %s: %v", ip, err)
+		return nil
+	}
+	slices := make([]*discoveryv1.EndpointSlice, 0, len(objs))
+	for _, obj := range objs {
+		slices = append(slices, obj.(*discoveryv1.EndpointSlice))
+	}
+	return slices
+}
+
+// podIPKeys indexes a pod by all of its IPs. Host network pods share the IP
+// of their node and are left out.
+func podIPKeys(obj any) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Spec.HostNetwork {
+		return nil, nil
+	}
+	ips := []string{pod.Status.PodIP}
+	for _, podIP := range pod.Status.PodIPs {
+		ips = append(ips, podIP.IP)
+	}
+	return normalizeIPs(ips), nil
+}
+
+// clusterIPKeys indexes a service by its cluster IPs. Headless and
+// ExternalName services have none.
+func clusterIPKeys(obj any) ([]string, error) {
+	svc, ok := obj.(*v1.Service)
+	if !ok {
+		return nil, nil
+	}
+	return normalizeIPs(append([]string{svc.Spec.ClusterIP}, svc.Spec.ClusterIPs...)), nil
+}
+
+// sliceServiceKeys indexes an EndpointSlice by the namespace/name of its
+// service.
+func sliceServiceKeys(obj any) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	name := slice.Labels[discoveryv1.LabelServiceName]
+	if name == "" {
+		return nil, nil
+	}
+	return []string{slice.Namespace + "/" + name}, nil
+}
+
+// sliceEndpointIPKeys indexes an EndpointSlice by the addresses of its
+// endpoints.
+func sliceEndpointIPKeys(obj any) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	var ips []string
+	for _, ep := range slice.Endpoints {
+		ips = append(ips, ep.Addresses...)
+	}
+	return normalizeIPs(ips), nil
+}
+
+// normalizeIPs returns the distinct valid addresses of ips in the form of
+// normalizeIP, skipping "None" and empty ones.
+func normalizeIPs(ips []string) []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, ip := range ips {
+		key := normalizeIP(ip)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// normalizeIP writes ip in one form, so that differently written IPv6
+// addresses share an index key. Invalid addresses become "".
+func normalizeIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	return addr.Unmap().String()
+}
+
+// stripManagedFields drops managed fields from cached objects, they are
+// large and never read.
+func stripManagedFields(obj any) (any, error) {
+	if accessor, err := meta.Accessor(obj); err == nil {
+		accessor.SetManagedFields(nil)
+	}
+	return obj, nil
+}
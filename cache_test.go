@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestCache returns a synced cache of objects, stopped when the test ends.
+func newTestCache(t *testing.T, objects ...runtime.Object) *clusterCache {
+	t.Helper()
+	c, _ := newTestCacheClient(t, objects...)
+	return c
+}
+
+func newTestCacheClient(t *testing.T, objects ...runtime.Object) (*clusterCache, *fake.Clientset) {
+	t.Helper()
+	client := fake.NewSimpleClientset(objects...)
+	c := newClusterCache(client)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := c.start(ctx); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	return c, client
+}
+
+func TestClusterCacheLookup(t *testing.T) {
+	c := newTestCache(t,
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+			Status: v1.PodStatus{
+				Phase:  v1.PodRunning,
+				PodIP:  "10.244.1.5",
+				PodIPs: []v1.PodIP{{IP: "10.244.1.5"}, {IP: "fd00:10:244:1::5"}},
+			},
+		},
+		// an exited pod whose IP was handed to web-0
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "job-0", Namespace: "default"},
+			Status:     v1.PodStatus{Phase: v1.PodSucceeded, PodIP: "10.244.1.5"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "kube-proxy-a", Namespace: "kube-system"},
+			Spec:       v1.PodSpec{HostNetwork: true},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "192.168.1.10"},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "kube-dns", Namespace: "kube-system"},
+			Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.10", ClusterIPs: []string{"10.96.0.10", "fd00:10:96::a"}},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "headless", Namespace: "default"},
+			Spec:       v1.ServiceSpec{ClusterIP: v1.ClusterIPNone, ClusterIPs: []string{v1.ClusterIPNone}},
+		},
+	)
+
+	tests := []struct {
+		ip       string
+		pod, svc string
+	}{
+		{"10.244.1.5", "web-0", ""},
+		{"fd00:10:244:1::5", "web-0", ""},
+		{"fd00:10:244:1:0:0:0:5", "web-0", ""},
+		{"10.96.0.10", "", "kube-dns"},
+		{"fd00:10:96:0::a", "", "kube-dns"},
+		{"192.168.1.10", "", ""},
+		{"10.244.1.6", "", ""},
+		{v1.ClusterIPNone, "", ""},
+		{"invalid", "", ""},
+	}
+
+	for _, test := range tests {
+		var pod, svc string
+		if p := c.podByIP(test.ip); p != nil {
+			pod = p.Name
+		}
+		if s := c.serviceByIP(test.ip); s != nil {
+			svc = s.Name
+		}
+		if pod != test.pod || svc != test.svc {
+			t.Errorf("lookup of %q = pod %q, service %q; want pod %q, service %q", test.ip, pod, svc, test.pod, test.svc)
+		}
+	}
+}
+
+func TestClusterCacheFollowsChanges(t *testing.T) {
+	c, client := newTestCacheClient(t)
+	pods := client.CoreV1().Pods("default")
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.244.1.5"},
+	}
+	if _, err := pods.Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	waitFor(t, "pod to be cached", func() bool { return c.podByIP("10.244.1.5") != nil })
+
+	if err := pods.Delete(context.TODO(), pod.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	waitFor(t, "pod to be dropped", func() bool { return c.podByIP("10.244.1.5") == nil })
+}
+
+func TestClusterCacheStartFails(t *testing.T) {
+	saved := cacheSyncTimeout
+	cacheSyncTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { cacheSyncTimeout = saved })
+
+	tests := []struct {
+		name    string
+		listErr error
+		want    string
+	}{
+		{"forbidden", apierrors.NewForbidden(v1.Resource("pods"), "", errors.New("RBAC: access denied")), "cannot list and watch pods"},
+		{"unreachable", errors.New("connection refused"), "timed out"},
+	}
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		client.PrependReactor("list", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, test.listErr
+		})
+		c := newClusterCache(client)
+		ctx, cancel := context.WithCancel(context.Background())
+		err := c.start(ctx)
+		cancel()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("start() %s = %v; want an error with %q", test.name, err, test.want)
+		}
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// The cluster zone is answered from the informer cache, following the
+// Kubernetes DNS-Based Service Discovery specification:
+//
+//	<service>.<ns>.svc.<zone>                  A/AAAA of the cluster IPs, of the ready endpoints of a headless service, or CNAME of an ExternalName service
+//	<hostname>.<service>.<ns>.svc.<zone>       A/AAAA of an endpoint of a headless service
+//	_<port>._<proto>.<service>.<ns>.svc.<zone> SRV of a named service port
+//	<a-b-c-d>.<ns>.pod.<zone>                  A/AAAA of a pod
+//	dns-version.<zone>                         TXT of the specification version
+//
+// and PTR records for cluster IPs and the endpoints of headless services.
+
+const (
+	clusterDNSTTL    = 5
+	dnsSchemaVersion = "1.1.0"
+)
+
+// resolveCluster answers r from the cache when its question is a name in
+// zone or the reverse name of a cluster IP or headless endpoint. It returns
+// nil for questions it is not authoritative for.
+func (c *clusterCache) resolveCluster(r *dns.Msg, zone string) *dns.Msg {
+	if len(r.Question) != 1 {
+		return nil
+	}
+	q := r.Question[0]
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	zone = strings.ToLower(dns.Fqdn(zone))
+
+	if !dns.IsSubDomain(zone, name) {
+		if q.Qtype != dns.TypePTR {
+			return nil
+		}
+		target := c.reverse(name, zone)
+		if target == "" {
+			return nil
+		}
+		m := clusterReply(r)
+		m.Answer = []dns.RR{&dns.PTR{Hdr: rrHeader(q.Name, dns.TypePTR), Ptr: target}}
+		return m
+	}
+
+	m := clusterReply(r)
+	rrs, exists := c.records(name, zone)
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == q.Qtype || q.Qtype == dns.TypeANY || t == dns.TypeCNAME {
+			rr.Header().Name = q.Name
+			m.Answer = append(m.Answer, rr)
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{zoneSOA(zone)}
+	}
+	// SRV targets come with their addresses
+	for _, rr := range m.Answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			targets, _ := c.records(srv.Target, zone)
+			for _, t := range targets {
+				if t.Header().Rrtype == dns.TypeA || t.Header().Rrtype == dns.TypeAAAA {
+					m.Extra = append(m.Extra, t)
+				}
+			}
+		}
+	}
+	return m
+}
+
+func clusterReply(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	return m
+}
+
+// records returns all records of name, a lower case name in zone, and
+// whether the name exists at all.
+func (c *clusterCache) records(name, zone string) ([]dns.RR, bool) {
+	rel := strings.TrimSuffix(strings.TrimSuffix(name, zone), ".")
+	if rel == "" {
+		return []dns.RR{zoneSOA(zone)}, true
+	}
+	if rel == "dns-version" {
+		return []dns.RR{&dns.TXT{Hdr: rrHeader(name, dns.TypeTXT), Txt: []string{dnsSchemaVersion}}}, true
+	}
+
+	labels := dns.SplitDomainName(rel)
+	n := len(labels)
+	switch {
+	case labels[n-1] == "svc" && n == 1, labels[n-1] == "pod" && n == 1:
+		return nil, true
+	case labels[n-1] == "svc" || labels[n-1] == "pod":
+		if !c.hasNamespace(labels[n-2]) {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	namespace := labels[n-2]
+
+	if labels[n-1] == "pod" {
+		switch n {
+		case 2:
+			return nil, true
+		case 3:
+			return c.podRecords(name, labels[0], namespace)
+		}
+		return nil, false
+	}
+
+	switch n {
+	case 2:
+		return nil, true
+	case 3:
+		svc := c.service(namespace, labels[0])
+		if svc == nil {
+			return nil, false
+		}
+		return c.serviceRecords(name, svc), true
+	case 4:
+		svc := c.service(namespace, labels[1])
+		if svc == nil || svc.Spec.ClusterIP != v1.ClusterIPNone {
+			return nil, false
+		}
+		var rrs []dns.RR
+		for _, ep := range c.dnsEndpoints(svc) {
+			if ep.hostname == labels[0] {
+				rrs = append(rrs, addrRR(name, ep.addr))
+			}
+		}
+		return rrs, len(rrs) > 0
+	case 5:
+		if !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+			return nil, false
+		}
+		svc := c.service(namespace, labels[2])
+		if svc == nil {
+			return nil, false
+		}
+		rrs := c.srvRecords(name, svc, labels[0][1:], labels[1][1:], zone)
+		return rrs, len(rrs) > 0
+	}
+	return nil, false
+}
+
+// serviceRecords returns the records of the name of svc.
+func (c *clusterCache) serviceRecords(name string, svc *v1.Service) []dns.RR {
+	var rrs []dns.RR
+	switch {
+	case svc.Spec.Type == v1.ServiceTypeExternalName:
+		if svc.Spec.ExternalName != "" {
+			rrs = append(rrs, &dns.CNAME{Hdr: rrHeader(name, dns.TypeCNAME), Target: dns.Fqdn(svc.Spec.ExternalName)})
+		}
+	case svc.Spec.ClusterIP == v1.ClusterIPNone:
+		for _, ep := range c.dnsEndpoints(svc) {
+			rrs = append(rrs, addrRR(name, ep.addr))
+		}
+	default:
+		for _, ip := range normalizeIPs(append([]string{svc.Spec.ClusterIP}, svc.Spec.ClusterIPs...)) {
+			rrs = append(rrs, addrRR(name, ip))
+		}
+	}
+	return rrs
+}
+
+// srvRecords returns the SRV records of the service port called port with
+// protocol proto. They point at the service name, or at every endpoint of
+// a headless service.
+func (c *clusterCache) srvRecords(name string, svc *v1.Service, port, proto, zone string) []dns.RR {
+	var rrs []dns.RR
+	serviceName := svc.Name + "." + svc.Namespace + ".svc." + zone
+	if svc.Spec.ClusterIP != v1.ClusterIPNone {
+		for _, sp := range svc.Spec.Ports {
+			if sp.Name == port && strings.EqualFold(string(protocolOrTCP(sp.Protocol)), proto) {
+				rrs = append(rrs, srvRR(name, sp.Port, serviceName))
+			}
+		}
+		return rrs
+	}
+	for _, ep := range c.dnsEndpoints(svc) {
+		for _, p := range ep.ports {
+			if p.Name != nil && *p.Name == port && p.Port != nil &&
+				p.Protocol != nil && strings.EqualFold(string(*p.Protocol), proto) {
+				rrs = append(rrs, srvRR(name, *p.Port, ep.hostname+"."+serviceName))
+			}
+		}
+	}
+	return rrs
+}
+
+// podRecords returns the records of the pod with the dashed address ip in
+// namespace.
+func (c *clusterCache) podRecords(name, ip, namespace string) ([]dns.RR, bool) {
+	addr, err := netip.ParseAddr(strings.ReplaceAll(ip, "-", "."))
+	if err != nil {
+		addr, err = netip.ParseAddr(strings.ReplaceAll(ip, "-", ":"))
+	}
+	if err != nil {
+		return nil, false
+	}
+	pod := c.podByIP(addr.String())
+	if pod == nil || pod.Namespace != namespace {
+		return nil, false
+	}
+	return []dns.RR{addrRR(name, addr.String())}, true
+}
+
+// reverse returns the name of the cluster address behind the reverse name
+// arpa, or "" when it is not a cluster IP or headless endpoint.
+func (c *clusterCache) reverse(arpa, zone string) string {
+	addr, ok := reverseAddr(arpa)
+	if !ok {
+		return ""
+	}
+	ip := addr.String()
+	if svc := c.serviceByIP(ip); svc != nil {
+		return svc.Name + "." + svc.Namespace + ".svc." + zone
+	}
+	for _, slice := range c.slicesByEndpointIP(ip) {
+		svc := c.service(slice.Namespace, slice.Labels[discoveryv1.LabelServiceName])
+		if svc == nil || svc.Spec.ClusterIP != v1.ClusterIPNone {
+			continue
+		}
+		for _, ep := range c.dnsEndpoints(svc) {
+			if ep.addr == ip {
+				return ep.hostname + "." + svc.Name + "." + svc.Namespace + ".svc." + zone
+			}
+		}
+	}
+	return ""
+}
+
+// dnsEndpoint is an address of a headless service endpoint published in DNS.
+type dnsEndpoint struct {
+	hostname string
+	addr     string
+	ports    []discoveryv1.EndpointPort
+}
+
+// dnsEndpoints returns the addresses of the ready endpoints of svc, or of all
+// of them when the service publishes not ready addresses. Endpoints without
+// a hostname are named after their address.
+func (c *clusterCache) dnsEndpoints(svc *v1.Service) []dnsEndpoint {
+	var eps []dnsEndpoint
+	seen := map[string]bool{}
+	for _, slice := range c.serviceSlices(svc) {
+		for _, ep := range slice.Endpoints {
+			ready := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+			if !ready && !svc.Spec.PublishNotReadyAddresses {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				addr = normalizeIP(addr)
+				if addr == "" || seen[addr] {
+					continue
+				}
+				seen[addr] = true
+				hostname := strings.NewReplacer(".", "-", ":", "-").Replace(addr)
+				if ep.Hostname != nil && *ep.Hostname != "" {
+					hostname = *ep.Hostname
+				}
+				eps = append(eps, dnsEndpoint{hostname: hostname, addr: addr, ports: slice.Ports})
+			}
+		}
+	}
+	return eps
+}
+
+// reverseAddr parses an in-addr.arpa or ip6.arpa name.
+func reverseAddr(arpa string) (netip.Addr, bool) {
+	labels := dns.SplitDomainName(strings.ToLower(arpa))
+	n := len(labels)
+	switch {
+	case n == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+		octets := slices.Clone(labels[:4])
+		slices.Reverse(octets)
+		addr, err := netip.ParseAddr(strings.Join(octets, "."))
+		return addr, err == nil && addr.Is4()
+	case n == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+		var b strings.Builder
+		for i := 31; i >= 0; i-- {
+			if len(labels[i]) != 1 {
+				return netip.Addr{}, false
+			}
+			b.WriteString(labels[i])
+			if i%4 == 0 && i > 0 {
+				b.WriteByte(':')
+			}
+		}
+		addr, err := netip.ParseAddr(b.String())
+		return addr, err == nil && addr.Is6()
+	}
+	return netip.Addr{}, false
+}
+
+func rrHeader(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: clusterDNSTTL}
+}
+
+// addrRR returns the A or AAAA record of ip.
+func addrRR(name, ip string) dns.RR {
+	addr := netip.MustParseAddr(ip)
+	if addr.Is4() {
+		return &dns.A{Hdr: rrHeader(name, dns.TypeA), A: addr.AsSlice()}
+	}
+	return &dns.AAAA{Hdr: rrHeader(name, dns.TypeAAAA), AAAA: addr.AsSlice()}
+}
+
+func srvRR(name string, port int32, target string) dns.RR {
+	return &dns.SRV{Hdr: rrHeader(name, dns.TypeSRV), Priority: 0, Weight: 100, Port: uint16(port), Target: target}
+}
+
+func zoneSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     rrHeader(zone, dns.TypeSOA),
+		Ns:      "ns.dns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  clusterDNSTTL,
+	}
+}
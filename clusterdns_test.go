@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestClusterDNS(t *testing.T) *clusterCache {
+	t.Helper()
+	yes, no := true, false
+	pg, tcp, port := "pg", v1.ProtocolTCP, int32(5432)
+	hostname := "db-0"
+
+	return newTestCache(t,
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				ClusterIP:  "10.96.0.20",
+				ClusterIPs: []string{"10.96.0.20", "fd00:10:96::20"},
+				Ports: []v1.ServicePort{
+					{Name: "http", Port: 80},
+					{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+				},
+			},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"},
+			Spec:       v1.ServiceSpec{ClusterIP: v1.ClusterIPNone},
+		},
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "db-abc",
+				Namespace: "default",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "db"},
+			},
+			Ports: []discoveryv1.EndpointPort{{Name: &pg, Protocol: &tcp, Port: &port}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.244.0.7"}, Hostname: &hostname, Conditions: discoveryv1.EndpointConditions{Ready: &yes}},
+				{Addresses: []string{"10.244.0.8"}},
+				{Addresses: []string{"10.244.0.9"}, Conditions: discoveryv1.EndpointConditions{Ready: &no}},
+			},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "ext", Namespace: "default"},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "example.com"},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.244.0.5"},
+		},
+	)
+}
+
+// rrData formats the type and data of rr, without owner name and TTL.
+func rrData(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return "A " + rr.A.String()
+	case *dns.AAAA:
+		return "AAAA " + rr.AAAA.String()
+	case *dns.CNAME:
+		return "CNAME " + rr.Target
+	case *dns.PTR:
+		return "PTR " + rr.Ptr
+	case *dns.SRV:
+		return fmt.Sprintf("SRV %d %s", rr.Port, rr.Target)
+	case *dns.TXT:
+		return "TXT " + strings.Join(rr.Txt, " ")
+	default:
+		return dns.TypeToString[rr.Header().Rrtype]
+	}
+}
+
+func TestResolveCluster(t *testing.T) {
+	c := newTestClusterDNS(t)
+	web6, _ := dns.ReverseAddr("fd00:10:96::20")
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  []string
+	}{
+		{"web.default.svc.cluster.local.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.96.0.20"}},
+		{"WEB.Default.svc.cluster.local.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA fd00:10:96::20"}},
+		{"web.default.svc.cluster.local.", dns.TypeMX, dns.RcodeSuccess, nil},
+		{"missing.default.svc.cluster.local.", dns.TypeA, dns.RcodeNameError, nil},
+		{"web.nope.svc.cluster.local.", dns.TypeA, dns.RcodeNameError, nil},
+		{"default.svc.cluster.local.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"db.default.svc.cluster.local.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.244.0.7", "A 10.244.0.8"}},
+		{"db-0.db.default.svc.cluster.local.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.244.0.7"}},
+		{"10-244-0-8.db.default.svc.cluster.local.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.244.0.8"}},
+		{"10-244-0-9.db.default.svc.cluster.local.", dns.TypeA, dns.RcodeNameError, nil},
+		{"web-0.web.default.svc.cluster.local.", dns.TypeA, dns.RcodeNameError, nil},
+		{"_http._tcp.web.default.svc.cluster.local.", dns.TypeSRV, dns.RcodeSuccess, []string{"SRV 80 web.default.svc.cluster.local."}},
+		{"_dns._udp.web.default.svc.cluster.local.", dns.TypeSRV, dns.RcodeSuccess, []string{"SRV 53 web.default.svc.cluster.local."}},
+		{"_http._udp.web.default.svc.cluster.local.", dns.TypeSRV, dns.RcodeNameError, nil},
+		{"_pg._tcp.db.default.svc.cluster.local.", dns.TypeSRV, dns.RcodeSuccess, []string{
+			"SRV 5432 db-0.db.default.svc.cluster.local.",
+			"SRV 5432 10-244-0-8.db.default.svc.cluster.local.",
+		}},
+		{"ext.default.svc.cluster.local.", dns.TypeA, dns.RcodeSuccess, []string{"CNAME example.com."}},
+		{"10-244-0-5.default.pod.cluster.local.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.244.0.5"}},
+		{"10-244-0-6.default.pod.cluster.local.", dns.TypeA, dns.RcodeNameError, nil},
+		{"dns-version.cluster.local.", dns.TypeTXT, dns.RcodeSuccess, []string{"TXT " + dnsSchemaVersion}},
+		{"cluster.local.", dns.TypeSOA, dns.RcodeSuccess, []string{"SOA"}},
+		{"other.cluster.local.", dns.TypeA, dns.RcodeNameError, nil},
+		{"20.0.96.10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"PTR web.default.svc.cluster.local."}},
+		{web6, dns.TypePTR, dns.RcodeSuccess, []string{"PTR web.default.svc.cluster.local."}},
+		{"7.0.244.10.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"PTR db-0.db.default.svc.cluster.local."}},
+	}
+
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		resp := c.resolveCluster(req, "cluster.local")
+		if resp == nil {
+			t.Errorf("resolveCluster(%s %s) = nil", test.name, dns.TypeToString[test.qtype])
+			continue
+		}
+		var got []string
+		for _, rr := range resp.Answer {
+			got = append(got, rrData(rr))
+			if rr.Header().Name != test.name {
+				t.Errorf("resolveCluster(%s) answer owner = %s", test.name, rr.Header().Name)
+			}
+		}
+		if resp.Rcode != test.rcode || !resp.Authoritative || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("resolveCluster(%s %s) = %s, aa %v, %q; want %s, %q", test.name, dns.TypeToString[test.qtype],
+				dns.RcodeToString[resp.Rcode], resp.Authoritative, got, dns.RcodeToString[test.rcode], test.want)
+		}
+		if len(resp.Answer) == 0 && len(resp.Ns) != 1 {
+			t.Errorf("resolveCluster(%s) without answers has %d authority records; want the SOA", test.name, len(resp.Ns))
+		}
+	}
+}
+
+func TestResolveClusterSRVAddresses(t *testing.T) {
+	c := newTestClusterDNS(t)
+	req := new(dns.Msg)
+	req.SetQuestion("_http._tcp.web.default.svc.cluster.local.", dns.TypeSRV)
+	resp := c.resolveCluster(req, "cluster.local")
+
+	var got []string
+	for _, rr := range resp.Extra {
+		got = append(got, rr.Header().Name+" "+rrData(rr))
+	}
+	want := []string{"web.default.svc.cluster.local. A 10.96.0.20", "web.default.svc.cluster.local. AAAA fd00:10:96::20"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SRV additional records = %q; want %q", got, want)
+	}
+}
+
+func TestResolveClusterNotAuthoritative(t *testing.T) {
+	c := newTestClusterDNS(t)
+	for _, q := range []dns.Question{
+		{Name: "example.com.", Qtype: dns.TypeA},
+		// pod IPs outside headless services have no PTR record
+		{Name: "5.0.244.10.in-addr.arpa.", Qtype: dns.TypePTR},
+		{Name: "1.1.1.1.in-addr.arpa.", Qtype: dns.TypePTR},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(q.Name, q.Qtype)
+		if resp := c.resolveCluster(req, "cluster.local"); resp != nil {
+			t.Errorf("resolveCluster(%s) = %v; want nil", q.Name, resp)
+		}
+	}
+}
+
+func TestReverseAddr(t *testing.T) {
+	for _, ip := range []string{"10.96.0.1", "fd00:10:96::a", "2001:db8::1:0:0:1"} {
+		arpa, _ := dns.ReverseAddr(ip)
+		addr, ok := reverseAddr(arpa)
+		if !ok || addr.String() != ip {
+			t.Errorf("reverseAddr(%s) = %v, %v; want %s", arpa, addr, ok, ip)
+		}
+	}
+	for _, arpa := range []string{"1.0.96.in-addr.arpa.", "x.0.96.10.in-addr.arpa.", "example.com."} {
+		if addr, ok := reverseAddr(arpa); ok {
+			t.Errorf("reverseAddr(%s) = %v; want not ok", arpa, addr)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// localRoute is a route of the host, or a network attached to one of its
+// interfaces when Connected is set.
+type localRoute struct {
+	Dst       netip.Prefix
+	Gateway   netip.Addr
+	Interface string
+	Connected bool
+}
+
+// routeConflict describes a cluster subnet clashing with a local route.
+// Fatal conflicts cut the host off from its gateway or LAN.
+type routeConflict struct {
+	Subnet netip.Prefix
+	Route  localRoute
+	Fatal  bool
+	Reason string
+}
+
+func (c routeConflict) String() string {
+	return fmt.Sprintf("cluster subnet %s %s", c.Subnet, c.Reason)
+}
+
+// findConflicts checks subnets against the local routes. The longest prefix
+// wins, so a subnet at least as specific as a local network takes it over,
+// while a wider one only loses the overlapping cluster addresses. Routes on
+// link, the tunnel itself, are ignored.
+func findConflicts(subnets []netip.Prefix, routes []localRoute, link string) []routeConflict {
+	var conflicts []routeConflict
+	for _, s := range subnets {
+		for _, r := range routes {
+			if r.Interface == link {
+				continue
+			}
+			c := routeConflict{Subnet: s, Route: r}
+			switch {
+			case r.Dst.Bits() == 0 && s.Bits() == 0 && s.Overlaps(r.Dst):
+				c.Fatal = true
+				c.Reason = fmt.Sprintf("would replace the default route on %s", r.Interface)
+			case r.Dst.Bits() == 0:
+				if !r.Gateway.IsValid() || !s.Contains(r.Gateway) || s.Bits() < longestMatch(routes, r.Gateway, link) {
+					continue
+				}
+				c.Fatal = true
+				c.Reason = fmt.Sprintf("would take over the default gateway %s on %s", r.Gateway, r.Interface)
+			case !s.Overlaps(r.Dst):
+				continue
+			case r.Connected && s.Bits() >= r.Dst.Bits():
+				c.Fatal = true
+				c.Reason = fmt.Sprintf("would take over the local network %s on %s", r.Dst, r.Interface)
+			case r.Connected:
+				c.Reason = fmt.Sprintf("contains the local network %s on %s, cluster addresses in it are unreachable", r.Dst, r.Interface)
+			case s.Bits() >= r.Dst.Bits():
+				c.Reason = fmt.Sprintf("overrides the route %s on %s", r.Dst, r.Interface)
+			default:
+				c.Reason = fmt.Sprintf("is partly covered by the route %s on %s, cluster addresses in it are unreachable", r.Dst, r.Interface)
+			}
+			conflicts = append(conflicts, c)
+		}
+	}
+	return conflicts
+}
+
+// longestMatch returns the length of the most specific non-default route to
+// addr, or 0 if only a default route reaches it.
+func longestMatch(routes []localRoute, addr netip.Addr, link string) int {
+	best := 0
+	for _, r := range routes {
+		if r.Interface != link && r.Dst.Contains(addr) && r.Dst.Bits() > best {
+			best = r.Dst.Bits()
+		}
+	}
+	return best
+}
+
+// checkRouteConflicts logs the conflicts between subnets and the host
+// routes. Fatal ones are returned as an error unless opt.AllowRouteConflicts
+// is set.
+func checkRouteConflicts(subnets []netip.Prefix, opt *Opts) error {
+	routes, err := localNetwork()
+	if err != nil {
+		klog.Warningf("failed to read local routes, skipping conflict check: %v", err)
+		return nil
+	}
+
+	var fatal []string
+	for _, c := range findConflicts(subnets, routes, deviceName(opt.Device)) {
+		if c.Fatal && !opt.AllowRouteConflicts {
+			fatal = append(fatal, c.String())
+			continue
+		}
+		klog.Warningf("%s", c)
+	}
+	if len(fatal) > 0 {
+		return errors.New(strings.Join(fatal, "; ") + ", use --exclude-subnets to leave it out or --allow-route-conflicts to route it anyway")
+	}
+	return nil
+}
+
+// localNetwork returns the networks attached to local interfaces followed by
+// the routing table, without loopback, link-local and multicast ranges. It
+// is replaced in tests.
+var localNetwork = func() ([]localRoute, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	var out []localRoute
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, p := range localPrefixes(addrs) {
+			out = append(out, localRoute{Dst: p, Interface: iface.Name, Connected: true})
+		}
+	}
+
+	routes, err := localRoutes()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		addr := r.Dst.Addr()
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsMulticast() {
+			continue
+		}
+		connected := slices.ContainsFunc(out, func(c localRoute) bool {
+			return c.Connected && c.Dst == r.Dst && c.Interface == r.Interface
+		})
+		if !connected {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestFindConflicts(t *testing.T) {
+	routes := []localRoute{
+		{Dst: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("192.168.1.1"), Interface: "en0"},
+		{Dst: netip.MustParsePrefix("192.168.1.0/24"), Interface: "en0", Connected: true},
+		{Dst: netip.MustParsePrefix("10.8.0.0/16"), Interface: "utun4"},
+		{Dst: netip.MustParsePrefix("10.96.0.0/12"), Interface: "utun9"},
+	}
+
+	type result struct {
+		Fatal bool
+		Route string
+	}
+	tests := []struct {
+		subnet   string
+		expected []result
+	}{
+		{"172.16.0.0/12", nil},
+		// the tunnel's own routes are not a conflict
+		{"10.96.0.0/12", nil},
+		{"192.168.1.0/24", []result{{true, "0.0.0.0/0"}, {true, "192.168.1.0/24"}}},
+		{"192.168.1.128/25", []result{{true, "192.168.1.0/24"}}},
+		{"192.168.0.0/16", []result{{false, "192.168.1.0/24"}}},
+		{"10.0.0.0/8", []result{{false, "10.8.0.0/16"}}},
+		{"10.8.1.0/24", []result{{false, "10.8.0.0/16"}}},
+		{"0.0.0.0/0", []result{{true, "0.0.0.0/0"}, {false, "192.168.1.0/24"}, {false, "10.8.0.0/16"}}},
+	}
+
+	for _, test := range tests {
+		var got []result
+		for _, c := range findConflicts(prefixes(test.subnet), routes, "utun9") {
+			got = append(got, result{c.Fatal, c.Route.Dst.String()})
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("findConflicts(%s) = %v; want %v", test.subnet, got, test.expected)
+		}
+	}
+}
+
+func TestFindConflictsOffLinkGateway(t *testing.T) {
+	// a point-to-point uplink whose gateway is only reachable by default route
+	routes := []localRoute{
+		{Dst: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("100.64.0.1"), Interface: "ppp0"},
+	}
+
+	conflicts := findConflicts(prefixes("100.64.0.0/10"), routes, "utun9")
+	if len(conflicts) != 1 || !conflicts[0].Fatal {
+		t.Fatalf("findConflicts() = %v; want the default gateway conflict", conflicts)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// observedPrefixBits is the size of the ranges built from observed pod and
+// service IPs when the cluster does not publish its CIDRs.
+const observedPrefixBits = 16
+
+// serviceRangeRe extracts the service CIDR from the error the apiserver
+// returns for a cluster IP outside of it.
+var serviceRangeRe = regexp.MustCompile(`valid IPs is ([0-9a-fA-F.:]+/[0-9]+)`)
+
+// probeClusterIP is never inside a service range, so creating a service with
+// it makes the apiserver report the valid range.
+const probeClusterIP = "1.1.1.1"
+
+// discoverSubnets works out the pod and service ranges of the cluster so
+// that only those are routed through the tunnel.
+func discoverSubnets(ctx context.Context, client kubernetes.Interface) ([]netip.Prefix, error) {
+	pods, err := discoverPodCIDRs(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	services, err := discoverServiceCIDRs(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return mergePrefixes(append(pods, services...)), nil
+}
+
+// discoverPodCIDRs reads Node.spec.podCIDRs, falling back to the IPs of
+// running pods for CNIs that do not use node CIDRs and for users that may
+// not list nodes.
+func discoverPodCIDRs(ctx context.Context, client kubernetes.Interface) ([]netip.Prefix, error) {
+	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.Warningf("failed to list nodes, using observed pod IPs: %v", err)
+	} else {
+		var prefixes []netip.Prefix
+		for _, node := range nodes.Items {
+			cidrs := node.Spec.PodCIDRs
+			if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+				cidrs = []string{node.Spec.PodCIDR}
+			}
+			prefixes = append(prefixes, parsePrefixes(cidrs)...)
+		}
+		if len(prefixes) > 0 {
+			return prefixes, nil
+		}
+		klog.Infof("nodes have no pod CIDRs, using observed pod IPs")
+	}
+
+	pods, err := client.CoreV1().Pods("").List(ctx, metav1.ListOptions{FieldSelector: "status.phase=Running"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	var ips []string
+	for _, pod := range pods.Items {
+		if pod.Spec.HostNetwork {
+			continue
+		}
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
+		}
+	}
+	return observedPrefixes(ips), nil
+}
+
+// discoverServiceCIDRs reads the ServiceCIDR API, then asks the apiserver
+// for the range with a dry-run probe, and finally falls back to the cluster
+// IPs of existing services.
+func discoverServiceCIDRs(ctx context.Context, client kubernetes.Interface) ([]netip.Prefix, error) {
+	if list, err := client.NetworkingV1beta1().ServiceCIDRs().List(ctx, metav1.ListOptions{}); err == nil {
+		var prefixes []netip.Prefix
+		for _, cidr := range list.Items {
+			prefixes = append(prefixes, parsePrefixes(cidr.Spec.CIDRs)...)
+		}
+		if len(prefixes) > 0 {
+			return prefixes, nil
+		}
+	}
+
+	if prefix, ok := probeServiceCIDR(ctx, client); ok {
+		return []netip.Prefix{prefix}, nil
+	}
+
+	klog.Infof("service CIDR not found, using observed service IPs")
+	services, err := client.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	var ips []string
+	for _, svc := range services.Items {
+		ips = append(ips, svc.Spec.ClusterIPs...)
+	}
+	return observedPrefixes(ips), nil
+}
+
+// probeServiceCIDR dry-runs the creation of a service with an out-of-range
+// cluster IP and parses the range from the rejection.
+func probeServiceCIDR(ctx context.Context, client kubernetes.Interface) (netip.Prefix, bool) {
+	probe := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "kubectl-link-probe-"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: probeClusterIP,
+			Ports:     []v1.ServicePort{{Port: 80}},
+		},
+	}
+	_, err := client.CoreV1().Services("default").Create(ctx, probe, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+	if err == nil {
+		return netip.Prefix{}, false
+	}
+
+	m := serviceRangeRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return netip.Prefix{}, false
+	}
+	prefix, perr := netip.ParsePrefix(m[1])
+	if perr != nil {
+		return netip.Prefix{}, false
+	}
+	return prefix.Masked(), true
+}
+
+// parsePrefixes parses CIDRs, skipping invalid entries.
+func parsePrefixes(cidrs []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		if p, err := netip.ParsePrefix(cidr); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	return prefixes
+}
+
+// observedPrefixes widens IPs to observedPrefixBits ranges. IPv6 addresses
+// are skipped, their ranges can not be guessed from a few samples.
+func observedPrefixes(ips []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range ips {
+		ip, err := netip.ParseAddr(s)
+		if err != nil || !ip.Is4() {
+			continue
+		}
+		p, _ := ip.Prefix(observedPrefixBits)
+		prefixes = append(prefixes, p)
+	}
+	return mergePrefixes(prefixes)
+}
+
+// mergePrefixes sorts prefixes and drops duplicates and ranges already
+// covered by a wider one.
+func mergePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := slices.Clone(prefixes)
+	sortPrefixes(sorted)
+
+	var merged []netip.Prefix
+	for _, p := range sorted {
+		if n := len(merged); n > 0 && merged[n-1].Contains(p.Addr()) && merged[n-1].Bits() <= p.Bits() {
+			continue
+		}
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// localPrefixes converts interface addresses to prefixes, skipping loopback
+// and link-local ones.
+func localPrefixes(addrs []net.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		p, ok := ipNetPrefix(ipnet)
+		if !ok || p.Addr().IsLoopback() || p.Addr().IsLinkLocalUnicast() {
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func prefixes(s ...string) []netip.Prefix {
+	var ps []netip.Prefix
+	for _, p := range s {
+		ps = append(ps, netip.MustParsePrefix(p))
+	}
+	return ps
+}
+
+func TestMergePrefixes(t *testing.T) {
+	tests := []struct {
+		input    []netip.Prefix
+		expected []netip.Prefix
+	}{
+		{nil, nil},
+		{prefixes("10.244.1.0/24", "10.244.0.0/24"), prefixes("10.244.0.0/24", "10.244.1.0/24")},
+		{prefixes("10.244.1.0/24", "10.244.0.0/16", "10.244.1.0/24"), prefixes("10.244.0.0/16")},
+		{prefixes("fd00::/64", "10.96.0.0/12", "10.96.0.0/16"), prefixes("10.96.0.0/12", "fd00::/64")},
+	}
+
+	for _, test := range tests {
+		if got := mergePrefixes(test.input); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("mergePrefixes(%v) = %v; want %v", test.input, got, test.expected)
+		}
+	}
+}
+
+func TestDiscoverSubnetsFromNodesAndServiceCIDRs(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a"}, Spec: v1.NodeSpec{PodCIDRs: []string{"10.244.0.0/24"}}},
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "b"}, Spec: v1.NodeSpec{PodCIDR: "10.244.1.0/24"}},
+		&networkingv1beta1.ServiceCIDR{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubernetes"},
+			Spec:       networkingv1beta1.ServiceCIDRSpec{CIDRs: []string{"10.96.0.0/12"}},
+		},
+	)
+
+	got, err := discoverSubnets(context.TODO(), client)
+	if err != nil {
+		t.Fatalf("discoverSubnets() error = %v", err)
+	}
+	want := prefixes("10.96.0.0/12", "10.244.0.0/24", "10.244.1.0/24")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverSubnets() = %v; want %v", got, want)
+	}
+}
+
+func TestDiscoverSubnetsFromProbe(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a"}, Spec: v1.NodeSpec{PodCIDRs: []string{"10.244.0.0/24"}}},
+	)
+	client.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New(`Service "kubectl-link-probe-x" is invalid: spec.clusterIPs: Invalid value: []string{"1.1.1.1"}: failed to allocate IP 1.1.1.1: the provided IP (1.1.1.1) is not in the valid range. The range of valid IPs is 10.43.0.0/16`)
+	})
+
+	got, err := discoverSubnets(context.TODO(), client)
+	if err != nil {
+		t.Fatalf("discoverSubnets() error = %v", err)
+	}
+	want := prefixes("10.43.0.0/16", "10.244.0.0/24")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverSubnets() = %v; want %v", got, want)
+	}
+}
+
+func TestDiscoverSubnetsFromObservedIPs(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a"}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIPs: []v1.PodIP{{IP: "192.168.14.7"}, {IP: "fd00::7"}}},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "node-agent", Namespace: "kube-system"},
+			Spec:       v1.PodSpec{HostNetwork: true},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIPs: []v1.PodIP{{IP: "172.31.0.10"}}},
+		},
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       v1.ServiceSpec{ClusterIPs: []string{"172.20.5.1"}},
+		},
+	)
+
+	got, err := discoverSubnets(context.TODO(), client)
+	if err != nil {
+		t.Fatalf("discoverSubnets() error = %v", err)
+	}
+	want := prefixes("172.20.0.0/16", "192.168.0.0/16")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverSubnets() = %v; want %v", got, want)
+	}
+}
+
+func TestDiscoverSubnetsWithoutNodeAccess(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "a"}, Spec: v1.NodeSpec{PodCIDRs: []string{"10.244.0.0/24"}}},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIPs: []v1.PodIP{{IP: "192.168.14.7"}}},
+		},
+	)
+	client.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(v1.Resource("nodes"), "", errors.New("namespaced user"))
+	})
+	client.PrependReactor("create", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New(`spec.clusterIPs: Invalid value: []string{"1.1.1.1"}: The range of valid IPs is 10.43.0.0/16`)
+	})
+
+	got, err := discoverSubnets(context.TODO(), client)
+	if err != nil {
+		t.Fatalf("discoverSubnets() error = %v", err)
+	}
+	want := prefixes("10.43.0.0/16", "192.168.0.0/16")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("discoverSubnets() = %v; want %v", got, want)
+	}
+}
+
+func TestLocalPrefixes(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("192.168.1.20"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("10.0.0.5").To4(), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+	}
+
+	want := prefixes("192.168.1.0/24", "10.0.0.0/8")
+	if got := localPrefixes(addrs); !reflect.DeepEqual(got, want) {
+		t.Errorf("localPrefixes() = %v; want %v", got, want)
+	}
+}
@@ -1,162 +1,68 @@
 package main
 
 import (
-	"context"
 	"net"
+	"net/netip"
+	"slices"
 	"strings"
 
 	"github.com/miekg/dns"
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 )
 
 // User goes into browser and types;
 // 1) 172.0.0.1
-// - do rdns to get the hostname
 // 2) service.namespace.svc.cluster.local
 // - dns resolves ip 172.0.0.1
-// - do rdns to get the hostname
 // ----- And -----
-// - split the hostname to get the type(pod,svc), port, protocol, endpoint, service, namespace, and zone
-// - 1) if has endpoint is a pod
-// - get service to find selector
-// - get the pod by label app=service
-// - make sure the pod ip is the ip
-// - 2) if has no endpoint is a service
-// - so, get the service
-// - make sure the service cluster ip is the ip
-// - get the pod by label app=service
-// - return the pod
+// - 1) if the ip is a service cluster ip
+// - get the service's ready endpoints from its EndpointSlices
+// - return the endpoints' pods
+// - 2) otherwise it is a pod ip
+// - return the running pod with the ip
 // ----- And -----
-// - metadata plugin for coredns disabled by default
-// - but with srv records we can get port
-// - still, we need to get exact pod name to port forward
+// - all of it is read from the informer cache, so a lookup needs neither
+// - reverse dns nor calls to the apiserver
 
-func findPodByIP(client kubernetes.Interface, ip string, zone string) (pod *v1.Pod, err error) {
+// findPodsByIP returns the pods behind ip: the backends of a service IP, or
+// the pod itself for a pod IP.
+func findPodsByIP(c *clusterCache, ip string) []*v1.Pod {
 	klog.Infof("Finding pod by IP: %s", ip)
-	name, err := rdns(&net.TCPAddr{
-		IP:   net.ParseIP("localhost"),
-		Port: 5300,
-	}, ip)
-	if err != nil {
-		klog.Errorf("failed to do rdns: %v", err)
-		return nil, err
-	}
-	if name == "" {
-		klog.Errorf("failed to find name")
-		return nil, nil
-	}
-
-	_, _, _, service, namespace, endpoint := split(name, zone)
-
-	if service == "" || namespace == "" {
-		klog.Errorf("try direct pod lookup")
-		pods, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
-			FieldSelector: "status.phase=Running,status.podIP=" + ip,
-		})
-
-		if err != nil {
-			klog.Errorf("failed to list pods: %v", err)
-			return nil, err
-		}
-
-		if len(pods.Items) == 0 {
-			klog.Errorf("no pods found")
-			return nil, nil
+	if svc := c.serviceByIP(ip); svc != nil {
+		pods := c.serviceBackends(svc)
+		if len(pods) == 0 {
+			klog.Errorf("no ready endpoints found for service %s/%s", svc.Namespace, svc.Name)
 		}
-
-		return &pods.Items[0], nil
-	}
-
-	svc, err := client.CoreV1().Services(namespace).Get(context.TODO(), service, metav1.GetOptions{})
-	if err != nil {
-		klog.Errorf("failed to get service: %v", err)
-		return nil, err
-	}
-
-	if endpoint == "" {
-		if svc.Spec.ClusterIP != ip {
-			klog.Errorf("service cluster ip does not match: %s != %s", svc.Spec.ClusterIP, ip)
-			return nil, nil
-		}
-	}
-
-	selector := []string{}
-	for key, value := range svc.Spec.Selector {
-		selector = append(selector, key+"="+value)
+		return pods
 	}
-	pods, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: strings.Join(selector, ","),
-		FieldSelector: "status.phase=Running",
-	})
-	if err != nil {
-		klog.Errorf("failed to list pods: %v", err)
-		return nil, err
+	if pod := c.podByIP(ip); pod != nil {
+		return []*v1.Pod{pod}
 	}
+	klog.Errorf("no pods found")
+	return nil
+}
 
-	if endpoint != "" {
-		for _, pod := range pods.Items {
-			if pod.Status.PodIP == ip {
-				return &pod, nil
-			}
+// findZone returns the cluster zone named by the reverse lookup of ip on the
+// cluster DNS, or zone when the lookup fails or names none. The lookup is
+// best effort, CoreDNS may serve no reverse zones.
+func findZone(ip, zone string) string {
+	addr, err := net.ResolveTCPAddr("tcp", upstreamAddr)
+	if err == nil {
+		var full string
+		full, err = rdns(addr, ip)
+		if found := parseZone(full); err == nil && found != "" {
+			return found
 		}
 	}
-
-	if len(pods.Items) == 0 {
-		klog.Errorf("no pods found")
-		return nil, nil
-	}
-
-	return &pods.Items[0], nil
-}
-
-func split(name string, zone string) (_type, port, protocol, service, namespace, endpoint string) {
-	// Strip the zone from the name if it exists
-	if strings.Contains(name, zone) {
-		name = strings.Split(name, zone)[0]
-	}
-
-	// Determine if the name is for a pod or a service
-	switch {
-	case strings.Contains(name, ".pod."):
-		_type = "pod"
-		name = strings.Split(name, ".pod.")[0]
-	case strings.Contains(name, ".svc."):
-		_type = "svc"
-		name = strings.Split(name, ".svc.")[0]
-	default:
-		return "", "", "", "", "", ""
-	}
-
-	// Split the name by periods and process based on the number of parts
-	parts := strings.Split(name, ".")
-	switch len(parts) {
-	case 4: // _port._protocol.service.namespace.pod|svc.zone
-		port, protocol, service, namespace = parts[0], parts[1], parts[2], parts[3]
-	case 3: // endpoint.service.namespace.pod|svc.zone
-		endpoint, service, namespace = parts[0], parts[1], parts[2]
-	case 2: // service.namespace.pod|svc.zone
-		service, namespace = parts[0], parts[1]
-	default:
-		return "", "", "", "", "", ""
-	}
-
-	return _type, port, protocol, service, namespace, endpoint
-}
-
-func findZone(ip string) string {
-	full, err := rdns(&net.TCPAddr{
-		IP:   net.ParseIP("127.0.0.1"),
-		Port: 5300,
-	}, ip)
 	if err != nil {
-		return "error"
+		klog.Warningf("failed to look up the cluster zone, using %s: %v", zone, err)
 	}
-	return parseZone(full)
+	return zone
 }
 
+// parseZone returns the zone of a pod or service name, or "" for other
+// names.
 func parseZone(full string) string {
 	if strings.Contains(full, ".pod.") {
 		return strings.Split(full, ".pod.")[1]
@@ -164,7 +70,7 @@ func parseZone(full string) string {
 	if strings.Contains(full, ".svc.") {
 		return strings.Split(full, ".svc.")[1]
 	}
-	return "cluster.local"
+	return ""
 }
 
 func rdns(dnsAddr net.Addr, ip string) (full string, err error) {
@@ -202,49 +108,152 @@ func rdns(dnsAddr net.Addr, ip string) (full string, err error) {
 	return ans, nil
 }
 
-const (
-	localAddr    = ":53"
-	upstreamAddr = "localhost:5300"
-)
+// upstreamAddr is the DNS port forward to the cluster DNS.
+var upstreamAddr = "localhost:5300"
 
-func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	client := new(dns.Client)
-	req := new(dns.Msg)
+// dnsUDPSize is the EDNS0 buffer size advertised in answers.
+const dnsUDPSize = 1232
 
+// handleDNSRequest answers names in the cluster zone locally and forwards
+// everything else as it is, so EDNS0 options and the RD, CD and DO bits
+// reach the upstream: names matching a --dns-forward rule to its servers,
+// the --dns-zones to the cluster DNS and the rest to the host's resolvers.
+// Clients get SERVFAIL instead of a timeout when no upstream can be reached.
+func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
 	if len(r.Question) == 0 {
-		klog.Errorf("No questions in request")
+		writeDNSError(w, r, dns.RcodeFormatError)
+		return
+	}
+	q := r.Question[0]
+	// zone transfers and updates are not proxied
+	if r.Opcode != dns.OpcodeQuery || q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		writeDNSError(w, r, dns.RcodeRefused)
 		return
 	}
-	upstream := upstreamAddr
-	// filter out requests that are not for the cluster zone
-	if !strings.Contains(r.Question[0].Name, opt.DNSClusterZone) {
-		upstream = "1.1.1.1:53"
+
+	if isClusterName(q.Name) && q.Qtype == dns.TypeAAAA && !_routesIPv6.Load() {
+		// without IPv6 routes clients would try unreachable addresses first
+		resp := new(dns.Msg)
+		resp.SetReply(r)
+		writeDNSResponse(w, r, resp)
+		return
 	}
 
-	req.SetQuestion(r.Question[0].Name, r.Question[0].Qtype)
-	req.Id = r.Id
-	client.Net = "tcp"
+	// the cluster zone is answered locally, other zones by the cluster DNS
+	if resp := _cluster.resolveCluster(r, opt.DNSClusterZone); resp != nil {
+		writeDNSResponse(w, r, resp)
+		return
+	}
 
-	resp, _, err := client.Exchange(req, upstream)
+	var resp *dns.Msg
+	var err error
+	if _, ruled := _dnsUpstreams.match(q.Name); ruled || !isClusterName(q.Name) {
+		resp, err = _dnsUpstreams.exchange(r)
+	} else {
+		resp, err = _dnsPool.exchangeTCP(r, upstreamAddr)
+	}
 	if err != nil {
-		klog.Errorf("Failed to exchange: %v", err)
+		klog.Errorf("Failed to exchange %s: %v", q.Name, err)
+		writeDNSError(w, r, dns.RcodeServerFailure)
 		return
 	}
 
-	err = w.WriteMsg(resp)
-	if err != nil {
+	writeDNSResponse(w, r, resp)
+}
+
+// writeDNSError answers r with rcode.
+func writeDNSError(w dns.ResponseWriter, r *dns.Msg, rcode int) {
+	resp := new(dns.Msg)
+	resp.SetRcode(r, rcode)
+	writeDNSResponse(w, r, resp)
+}
+
+// writeDNSResponse fits resp to the client of r before writing it. It
+// carries an OPT record only when r did, and over UDP it is truncated to
+// the buffer size r advertised, or 512 bytes without EDNS0, with the TC bit
+// set so the client retries over TCP.
+func writeDNSResponse(w dns.ResponseWriter, r, resp *dns.Msg) {
+	size := dns.MaxMsgSize
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		size = dns.MinMsgSize
+	}
+
+	if o := r.IsEdns0(); o == nil {
+		resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeOPT
+		})
+	} else {
+		// the upstream's OPT keeps its options, only the buffer size is ours
+		if ro := resp.IsEdns0(); ro != nil {
+			ro.SetUDPSize(dnsUDPSize)
+		} else {
+			resp.SetEdns0(dnsUDPSize, o.Do())
+		}
+		if size == dns.MinMsgSize {
+			size = max(int(o.UDPSize()), dns.MinMsgSize)
+		}
+	}
+	resp.Truncate(size)
+
+	if err := w.WriteMsg(resp); err != nil {
 		klog.Errorf("Failed to write response: %v", err)
 	}
 }
 
-func StartDNSProxy() error {
-	server := &dns.Server{Addr: localAddr, Net: "udp", Handler: dns.HandlerFunc(handleDNSRequest)}
+// routesIPv6 reports whether any of subnets is an IPv6 range.
+func routesIPv6(subnets []netip.Prefix) bool {
+	for _, subnet := range subnets {
+		if subnet.Addr().Is6() {
+			return true
+		}
+	}
+	return false
+}
 
-	klog.Infof("Starting DNS proxy on %s", localAddr)
-	err := server.ListenAndServe()
+// isClusterName reports whether name belongs to the cluster zone or one of
+// the extra --dns-zones.
+func isClusterName(name string) bool {
+	if strings.Contains(name, opt.DNSClusterZone) {
+		return true
+	}
+	name = strings.TrimSuffix(name, ".")
+	for _, zone := range opt.DNSZones {
+		zone = strings.Trim(zone, ".")
+		if zone != "" && (name == zone || strings.HasSuffix(name, "."+zone)) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenDNS and listenDNSTCP open the DNS proxy sockets. They are replaced
+// by the helper's when privileges are dropped.
+var (
+	listenDNS = func() (net.PacketConn, error) {
+		return net.ListenPacket("udp", dnsListenAddr)
+	}
+	listenDNSTCP = func() (net.Listener, error) {
+		return net.Listen("tcp", dnsListenAddr)
+	}
+)
+
+// StartDNSProxy serves DNS over UDP and TCP on the same address, so clients
+// can retry truncated answers over TCP.
+func StartDNSProxy() error {
+	pc, err := listenDNS()
 	if err != nil {
 		return err
 	}
+	ln, err := listenDNSTCP()
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	handler := dns.HandlerFunc(handleDNSRequest)
 
-	return nil
+	klog.Infof("Starting DNS proxy on %s (udp and tcp)", pc.LocalAddr())
+	errc := make(chan error, 2)
+	go func() { errc <- (&dns.Server{PacketConn: pc, Handler: handler}).ActivateAndServe() }()
+	go func() { errc <- (&dns.Server{Listener: ln, Handler: handler}).ActivateAndServe() }()
+	return <-errc
 }
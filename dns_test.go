@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 func TestParseZone(t *testing.T) {
@@ -16,7 +21,7 @@ func TestParseZone(t *testing.T) {
 		{"_port._protocol.service.namespace.svc.zone", "zone"},
 		{"endpoint.service.namespace.svc.zone.a.a.a.a.a.a", "zone.a.a.a.a.a.a"},
 		{"service.namespace.svc.zone", "zone"},
-		{"asdasd", "cluster.local"},
+		{"asdasd", ""},
 	}
 
 	for _, test := range tests {
@@ -26,27 +31,40 @@ func TestParseZone(t *testing.T) {
 		}
 	}
 }
-func TestSplit(t *testing.T) {
-	tests := []struct {
-		name     string
-		zone     string
-		expected [6]string
-	}{
-		{"_port._protocol.service.namespace.pod.zone", "zone", [6]string{"pod", "_port", "_protocol", "service", "namespace", ""}},
-		{"endpoint.service.namespace.pod.zone", "zone", [6]string{"pod", "", "", "service", "namespace", "endpoint"}},
-		{"service.namespace.pod.zone", "zone", [6]string{"pod", "", "", "service", "namespace", ""}},
-		{"_port._protocol.service.namespace.svc.zone", "zone", [6]string{"svc", "_port", "_protocol", "service", "namespace", ""}},
-		{"endpoint.service.namespace.svc.zone", "zone", [6]string{"svc", "", "", "service", "namespace", "endpoint"}},
-		{"service.namespace.svc.zone", "zone", [6]string{"svc", "", "", "service", "namespace", ""}},
-		{"invalid.name", "zone", [6]string{"", "", "", "", "", ""}},
+
+func TestFindZone(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	server := &dns.Server{
+		Listener: ln,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if r.Question[0].Name == "2.0.244.10.in-addr.arpa." {
+				rr, _ := dns.NewRR(r.Question[0].Name + " 5 IN PTR 10-244-0-2.kube-dns.kube-system.svc.corp.internal.")
+				m.Answer = append(m.Answer, rr)
+			}
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
 
-	for _, test := range tests {
-		_type, port, protocol, service, namespace, endpoint := split(test.name, test.zone)
-		result := [6]string{_type, port, protocol, service, namespace, endpoint}
-		if result != test.expected {
-			t.Errorf("split(%q, %q) = %q; want %q", test.name, test.zone, result, test.expected)
-		}
+	saved := upstreamAddr
+	t.Cleanup(func() { upstreamAddr = saved })
+	upstreamAddr = ln.Addr().String()
+
+	if got := findZone("10.244.0.2", "cluster.local"); got != "corp.internal" {
+		t.Errorf("findZone() = %s; want the zone of the reverse name", got)
+	}
+	if got := findZone("10.244.0.3", "cluster.local"); got != "cluster.local" {
+		t.Errorf("findZone() without a reverse name = %s; want the configured zone", got)
+	}
+	upstreamAddr = "127.0.0.1:1"
+	if got := findZone("10.244.0.2", "cluster.local"); got != "cluster.local" {
+		t.Errorf("findZone() without the cluster DNS = %s; want the configured zone", got)
 	}
 }
 
@@ -64,3 +82,207 @@ func Test_rdns(t *testing.T) {
 	}
 
 }
+
+// startTestDNSProxy serves the DNS proxy on loopback, with the cluster DNS
+// replaced by upstream, or by a closed port when upstream is nil. It returns
+// the address both transports listen on.
+func startTestDNSProxy(t *testing.T, upstream dns.HandlerFunc) string {
+	t.Helper()
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upstream == nil {
+		up.Close()
+	} else {
+		upServer := &dns.Server{Listener: up, Handler: upstream}
+		go upServer.ActivateAndServe()
+		t.Cleanup(func() { upServer.Shutdown() })
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		t.Skipf("udp port %s taken: %v", ln.Addr(), err)
+	}
+
+	savedListen, savedListenTCP, savedUpstream, savedCluster := listenDNS, listenDNSTCP, upstreamAddr, _cluster
+	savedZone, savedZones := opt.DNSClusterZone, opt.DNSZones
+	listenDNS = func() (net.PacketConn, error) { return pc, nil }
+	listenDNSTCP = func() (net.Listener, error) { return ln, nil }
+	upstreamAddr = up.Addr().String()
+	_cluster = newTestCache(t)
+	opt.DNSClusterZone, opt.DNSZones = "cluster.local", []string{"example.internal"}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+		listenDNS, listenDNSTCP, upstreamAddr, _cluster = savedListen, savedListenTCP, savedUpstream, savedCluster
+		opt.DNSClusterZone, opt.DNSZones = savedZone, savedZones
+	})
+
+	go StartDNSProxy()
+	return ln.Addr().String()
+}
+
+// largeUpstream answers A queries with 100 records, about 1700 bytes, and
+// records whether queries carried the DO bit.
+func largeUpstream(do *atomic.Bool) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if o := r.IsEdns0(); o != nil && o.Do() {
+			do.Store(true)
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for i := 0; i < 100; i++ {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 5 IN A 10.244.1.%d", r.Question[0].Name, i))
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestDNSProxyTransports(t *testing.T) {
+	var do atomic.Bool
+	addr := startTestDNSProxy(t, largeUpstream(&do))
+
+	tests := []struct {
+		net       string
+		edns      uint16
+		truncated bool
+	}{
+		{"udp", 0, true},
+		{"udp", 1232, true},
+		{"udp", 4096, false},
+		{"tcp", 0, false},
+		{"tcp", 1232, false},
+	}
+
+	for _, test := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion("big.example.internal.", dns.TypeA)
+		if test.edns > 0 {
+			req.SetEdns0(test.edns, false)
+		}
+		client := &dns.Client{Net: test.net, UDPSize: 65535, Timeout: 5 * time.Second}
+		resp, _, err := client.Exchange(req, addr)
+		if err != nil {
+			t.Fatalf("%s exchange with EDNS0 size %d error = %v", test.net, test.edns, err)
+		}
+
+		size := dns.MinMsgSize
+		if test.edns > 0 {
+			size = int(test.edns)
+		}
+		resp.Compress = true
+		if test.net == "udp" && resp.Len() > size {
+			t.Errorf("%s answer with EDNS0 size %d is %d bytes", test.net, test.edns, resp.Len())
+		}
+		if resp.Truncated != test.truncated {
+			t.Errorf("%s answer with EDNS0 size %d truncated = %v; want %v", test.net, test.edns, resp.Truncated, test.truncated)
+		}
+		if !test.truncated && len(resp.Answer) != 100 {
+			t.Errorf("%s answer with EDNS0 size %d has %d records; want 100", test.net, test.edns, len(resp.Answer))
+		}
+		if hasOPT := resp.IsEdns0() != nil; hasOPT != (test.edns > 0) {
+			t.Errorf("%s answer with EDNS0 size %d has OPT = %v", test.net, test.edns, hasOPT)
+		}
+	}
+	if do.Load() {
+		t.Errorf("upstream got the DO bit without a client asking for it")
+	}
+}
+
+func TestDNSProxyPassesDOBit(t *testing.T) {
+	var do atomic.Bool
+	addr := startTestDNSProxy(t, largeUpstream(&do))
+
+	req := new(dns.Msg)
+	req.SetQuestion("big.example.internal.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	client := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("exchange error = %v", err)
+	}
+	if !do.Load() {
+		t.Errorf("upstream did not get the DO bit")
+	}
+	if o := resp.IsEdns0(); o == nil || !o.Do() {
+		t.Errorf("answer OPT = %v; want the DO bit", o)
+	}
+}
+
+func TestDNSProxyForwardsFaithfully(t *testing.T) {
+	received := make(chan *dns.Msg, 1)
+	addr := startTestDNSProxy(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		received <- r
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetEdns0(4096, true)
+		ede := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer}
+		m.IsEdns0().Option = append(m.IsEdns0().Option, ede)
+		w.WriteMsg(m)
+	})
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.example.internal.", dns.TypeA)
+	req.RecursionDesired = false
+	req.CheckingDisabled = true
+	req.SetEdns0(1232, true)
+	cookie := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"}
+	req.IsEdns0().Option = append(req.IsEdns0().Option, cookie)
+
+	client := &dns.Client{Net: "udp", Timeout: 5 * time.Second}
+	resp, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("exchange error = %v", err)
+	}
+
+	got := <-received
+	o := got.IsEdns0()
+	if got.Id != req.Id || got.RecursionDesired || !got.CheckingDisabled || o == nil || !o.Do() || len(o.Option) != 1 {
+		t.Errorf("upstream got %v; want the query as sent", got)
+	}
+	if ro := resp.IsEdns0(); ro == nil || len(ro.Option) != 1 || ro.Option[0].Option() != dns.EDNS0EDE {
+		t.Errorf("answer OPT = %v; want the upstream's extended error", ro)
+	}
+}
+
+func TestDNSProxyErrors(t *testing.T) {
+	addr := startTestDNSProxy(t, nil)
+
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("example.internal.")
+	notify := new(dns.Msg)
+	notify.SetNotify("example.internal.")
+	down := new(dns.Msg)
+	down.SetQuestion("web.example.internal.", dns.TypeA)
+	empty := new(dns.Msg)
+	empty.Id = dns.Id()
+
+	tests := []struct {
+		name  string
+		req   *dns.Msg
+		rcode int
+	}{
+		{"upstream down", down, dns.RcodeServerFailure},
+		{"zone transfer", axfr, dns.RcodeRefused},
+		{"notify", notify, dns.RcodeRefused},
+		{"no question", empty, dns.RcodeFormatError},
+	}
+
+	for _, test := range tests {
+		client := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
+		resp, _, err := client.Exchange(test.req, addr)
+		if err != nil {
+			t.Fatalf("%s: exchange error = %v", test.name, err)
+		}
+		if resp.Rcode != test.rcode {
+			t.Errorf("%s: rcode = %s; want %s", test.name, dns.RcodeToString[resp.Rcode], dns.RcodeToString[test.rcode])
+		}
+	}
+}
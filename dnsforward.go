@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/klog"
+)
+
+const (
+	// dnsUpstreamTimeout bounds dialing an upstream and each exchange.
+	dnsUpstreamTimeout = 5 * time.Second
+	// dnsMaxIdleConns is the number of idle connections kept per upstream.
+	dnsMaxIdleConns = 8
+)
+
+// _dnsPool carries the queries forwarded by the DNS proxy.
+var _dnsPool = newDNSPool()
+
+// dnsPool forwards queries to DNS upstreams over UDP, and over TCP when the
+// answer is truncated. TCP connections are reused; a connection carries one
+// exchange at a time, so answers never have to be matched across queries.
+type dnsPool struct {
+	udp *dns.Client
+	tcp *dns.Client
+
+	mu   sync.Mutex
+	idle map[string][]*dns.Conn
+}
+
+func newDNSPool() *dnsPool {
+	return &dnsPool{
+		udp:  &dns.Client{Net: "udp", Timeout: dnsUpstreamTimeout},
+		tcp:  &dns.Client{Net: "tcp", Timeout: dnsUpstreamTimeout},
+		idle: map[string][]*dns.Conn{},
+	}
+}
+
+// exchange sends req to addr as it is and returns the answer, retrying over
+// TCP when the UDP answer is truncated.
+func (p *dnsPool) exchange(req *dns.Msg, addr string) (*dns.Msg, error) {
+	resp, _, err := p.udp.Exchange(req, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		return p.exchangeTCP(req, addr)
+	}
+	return resp, nil
+}
+
+// exchangeTCP sends req to addr over TCP. An idle connection the upstream
+// closed in the meantime is replaced once. The cluster DNS is only reached
+// this way, streams to pods carry TCP only.
+func (p *dnsPool) exchangeTCP(req *dns.Msg, addr string) (*dns.Msg, error) {
+	for retried := false; ; retried = true {
+		conn, reused, err := p.get(addr)
+		if err != nil {
+			return nil, err
+		}
+		resp, _, err := p.tcp.ExchangeWithConn(req, conn)
+		if err == nil {
+			p.put(addr, conn)
+			return resp, nil
+		}
+		conn.Close()
+		if !reused || retried {
+			return nil, err
+		}
+	}
+}
+
+// get returns an idle connection to addr, or dials a new one.
+func (p *dnsPool) get(addr string) (conn *dns.Conn, reused bool, err error) {
+	p.mu.Lock()
+	if idle := p.idle[addr]; len(idle) > 0 {
+		conn = idle[len(idle)-1]
+		p.idle[addr] = idle[:len(idle)-1]
+		p.mu.Unlock()
+		return conn, true, nil
+	}
+	p.mu.Unlock()
+
+	conn, err = p.tcp.Dial(addr)
+	return conn, false, err
+}
+
+// put returns conn to the idle connections of addr, or closes it when there
+// are enough of them.
+func (p *dnsPool) put(addr string, conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[addr]) >= dnsMaxIdleConns {
+		conn.Close()
+		return
+	}
+	p.idle[addr] = append(p.idle[addr], conn)
+}
+
+// clusterDNSAddr returns the cluster IP of the service in front of the DNS pod,
+// so queries move on to the other DNS pods when it goes away, or the pod
+// itself when it has none.
+func clusterDNSAddr(c *clusterCache, pod *v1.Pod) string {
+	for _, slice := range c.slicesByEndpointIP(pod.Status.PodIP) {
+		svc := c.service(slice.Namespace, slice.Labels[discoveryv1.LabelServiceName])
+		if svc == nil {
+			continue
+		}
+		if ips, _ := clusterIPKeys(svc); len(ips) > 0 {
+			return net.JoinHostPort(ips[0], "53")
+		}
+	}
+	return net.JoinHostPort(pod.Status.PodIP, "53")
+}
+
+// serveClusterDNS relays the connections accepted on ln to the cluster DNS at
+// dst, each over its own stream, until ln is closed. A connection that cannot
+// be relayed is closed, the next one tries again.
+func serveClusterDNS(ln net.Listener, dst string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				klog.Errorf("cluster DNS listener failed: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := dialForwarded("", dst)
+			if err != nil {
+				klog.Errorf("failed to reach the cluster DNS at %s: %v", dst, err)
+				return
+			}
+			defer upstream.Close()
+			relay(conn, bufio.NewReader(conn), upstream)
+		}()
+	}
+}
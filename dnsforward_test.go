@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// countingListener counts the connections it accepted.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return c, err
+}
+
+func TestDNSPoolReusesConnections(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countingListener{Listener: ln}
+	server := &dns.Server{
+		Listener:    counted,
+		IdleTimeout: func() time.Duration { return 50 * time.Millisecond },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	p := newDNSPool()
+	exchange := func() {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion("web.example.internal.", dns.TypeA)
+		resp, err := p.exchangeTCP(req, ln.Addr().String())
+		if err != nil || resp.Id != req.Id {
+			t.Fatalf("exchange() = %v, %v", resp, err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		exchange()
+	}
+	if n := counted.accepted.Load(); n != 1 {
+		t.Errorf("5 exchanges used %d connections; want 1", n)
+	}
+
+	// the upstream drops the idle connection, the next exchange redials
+	time.Sleep(200 * time.Millisecond)
+	exchange()
+	if n := counted.accepted.Load(); n != 2 {
+		t.Errorf("exchange after a dropped connection used %d connections in total; want 2", n)
+	}
+}
+
+func TestDNSPoolUpstreamDown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.example.internal.", dns.TypeA)
+	if _, err := newDNSPool().exchange(req, ln.Addr().String()); err == nil {
+		t.Errorf("exchange() with the upstream down: expected error")
+	}
+}
+
+func TestDNSPoolTruncated(t *testing.T) {
+	// large answers are truncated over UDP and complete over TCP
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if w.LocalAddr().Network() == "udp" {
+			m.Truncated = true
+		} else {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 5 IN A 10.0.0.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	addr := startTestDNSServer(t, handler)
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.example.internal.", dns.TypeA)
+	resp, err := newDNSPool().exchange(req, addr)
+	if err != nil {
+		t.Fatalf("exchange() error = %v", err)
+	}
+	if resp.Truncated || len(resp.Answer) != 1 {
+		t.Errorf("exchange() of a truncated answer = %v; want the TCP answer", resp)
+	}
+}
+
+func TestClusterDNSAddr(t *testing.T) {
+	yes := true
+	c := newTestCache(t,
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "kube-dns", Namespace: "default"},
+			Spec:       v1.ServiceSpec{ClusterIP: "10.96.0.10"},
+		},
+		testSlice("kube-dns-a", "kube-dns", testEndpoint("10.244.0.2", "coredns-a", &yes, &yes, nil)),
+	)
+	tests := []struct {
+		ip, want string
+	}{
+		{"10.244.0.2", "10.96.0.10:53"},
+		{"10.244.0.3", "10.244.0.3:53"},
+	}
+	for _, test := range tests {
+		pod := &v1.Pod{Status: v1.PodStatus{PodIP: test.ip}}
+		if got := clusterDNSAddr(c, pod); got != test.want {
+			t.Errorf("clusterDNSAddr(%s) = %s; want %s", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestServeClusterDNSUnreachable(t *testing.T) {
+	// the service has no ready endpoints
+	withTestService(t, lbRoundRobin, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveClusterDNS(ln, "10.96.0.20:80")
+
+	// connections are closed, and the next ones are still accepted
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Read() from an unreachable cluster DNS = %v; want EOF", err)
+		}
+		conn.Close()
+	}
+}
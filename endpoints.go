@@ -0,0 +1,50 @@
+package main
+
+import (
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/klog"
+)
+
+// serviceBackends returns the pods behind svc according to its
+// EndpointSlices. Only ready, serving and non-terminating endpoints that
+// refer to a pod are used, since port-forward needs a pod to connect to.
+// A pod listed in several slices, as on dual-stack services, is returned once.
+func (c *clusterCache) serviceBackends(svc *v1.Service) []*v1.Pod {
+	var pods []*v1.Pod
+	seen := map[string]bool{}
+	for _, slice := range c.serviceSlices(svc) {
+		for _, ep := range slice.Endpoints {
+			ref := ep.TargetRef
+			if !endpointUsable(ep) || ref == nil || ref.Kind != "Pod" {
+				continue
+			}
+			namespace := ref.Namespace
+			if namespace == "" {
+				namespace = slice.Namespace
+			}
+			key := namespace + "/" + ref.Name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			pod, err := c.podLister.Pods(namespace).Get(ref.Name)
+			if err != nil {
+				klog.Warningf("endpoint pod %s is gone", key)
+				continue
+			}
+			pods = append(pods, pod)
+		}
+	}
+	return pods
+}
+
+// endpointUsable reports whether ep can take new connections. Unset ready and
+// serving conditions are treated as true, as the EndpointSlice API asks.
+func endpointUsable(ep discoveryv1.Endpoint) bool {
+	c := ep.Conditions
+	return (c.Ready == nil || *c.Ready) &&
+		(c.Serving == nil || *c.Serving) &&
+		(c.Terminating == nil || !*c.Terminating)
+}
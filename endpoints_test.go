@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func testEndpoint(ip, pod string, ready, serving, terminating *bool) discoveryv1.Endpoint {
+	ep := discoveryv1.Endpoint{
+		Addresses: []string{ip},
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       ready,
+			Serving:     serving,
+			Terminating: terminating,
+		},
+	}
+	if pod != "" {
+		ep.TargetRef = &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: pod}
+	}
+	return ep
+}
+
+func testSlice(name, service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		Endpoints: endpoints,
+	}
+}
+
+func TestServiceBackends(t *testing.T) {
+	yes, no := true, false
+	objects := []runtime.Object{
+		testSlice("web-v4", "web",
+			testEndpoint("10.244.0.1", "web-ready", &yes, &yes, &no),
+			testEndpoint("10.244.0.2", "web-unready", &no, &no, &no),
+			testEndpoint("10.244.0.3", "web-terminating", &no, &yes, &yes),
+			testEndpoint("10.244.0.4", "web-unknown", nil, nil, nil),
+			testEndpoint("10.244.0.5", "web-deleted", &yes, &yes, &no),
+		),
+		testSlice("web-v6", "web",
+			testEndpoint("fd00:10:244::1", "web-ready", &yes, &yes, &no),
+		),
+		testSlice("manual", "external",
+			testEndpoint("192.168.1.10", "", &yes, &yes, &no),
+		),
+		testSlice("other", "other",
+			testEndpoint("10.244.0.9", "other-0", &yes, &yes, &no),
+		),
+	}
+	for _, name := range []string{"web-ready", "web-unready", "web-terminating", "web-unknown", "other-0"} {
+		objects = append(objects, &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}})
+	}
+	c := newTestCache(t, objects...)
+
+	tests := []struct {
+		service string
+		want    []string
+	}{
+		{"web", []string{"web-ready", "web-unknown"}},
+		{"external", nil},
+		{"missing", nil},
+	}
+
+	for _, test := range tests {
+		svc := &v1.Service{ObjectMeta: metav1.ObjectMeta{Name: test.service, Namespace: "default"}}
+		pods := c.serviceBackends(svc)
+		var got []string
+		for _, pod := range pods {
+			got = append(got, pod.Name)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("serviceBackends(%s) = %v; want %v", test.service, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("serviceBackends(%s) = %v; want %v", test.service, got, test.want)
+				break
+			}
+		}
+	}
+}
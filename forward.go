@@ -4,10 +4,7 @@ import (
 	"context"
 	"errors"
 	"net"
-	"time"
 
-	"github.com/xjasonlyu/tun2socks/v2/dialer"
-	"github.com/xjasonlyu/tun2socks/v2/log"
 	M "github.com/xjasonlyu/tun2socks/v2/metadata"
 	"github.com/xjasonlyu/tun2socks/v2/proxy/proto"
 )
@@ -55,59 +52,35 @@ func NewDirect() *Direct {
 
 // DialContext dials a connection to the proxy.
 func (d *Direct) DialContext(ctx context.Context, metadata *M.Metadata) (net.Conn, error) {
-	fwd, err := GetForwardedService(_kclient, metadata.DestinationAddress())
-	if err != nil {
-		return nil, err
-	}
-	c, err := dialer.DialContext(ctx, "tcp", fwd.String())
-	if err != nil {
-		return nil, err
-	}
-	setKeepAlive(c)
-	return c, nil
+	return dialForwarded(metadata.SourceAddress(), metadata.DestinationAddress())
 }
 
-// DialUDP dials a UDP connection to the proxy.
-func (d *Direct) DialUDP(*M.Metadata) (net.PacketConn, error) {
-	pc, err := dialer.ListenPacket("udp", "")
-	if err != nil {
-		return nil, err
+// dialForwarded connects src to the cluster address dst over a stream to
+// one of its backends, setting the forward to its pod up on first use.
+func dialForwarded(src, dst string) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		b, f, err := GetForwardedService(src, dst)
+		if err != nil {
+			return nil, err
+		}
+		c, err := dialBackend(f, b)
+		if errors.Is(err, errForwardStopped) && attempt < forwardDialAttempts {
+			// the forward was stopped meanwhile, set it up again
+			continue
+		}
+		return c, err
 	}
-	return &directPacketConn{PacketConn: pc}, nil
-}
-
-type directPacketConn struct {
-	net.PacketConn
 }
 
-func (pc *directPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
-	if udpAddr, ok := addr.(*net.UDPAddr); ok {
-		return pc.PacketConn.WriteTo(b, udpAddr)
+// DialUDP dials a UDP connection to the proxy. Sessions go through the UDP
+// relay pod.
+func (d *Direct) DialUDP(*M.Metadata) (net.PacketConn, error) {
+	if _udpRelay == nil {
+		return nil, errors.ErrUnsupported
 	}
-
-	udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+	c, err := _udpRelay.dial(context.Background())
 	if err != nil {
-		return 0, err
-	}
-	return pc.PacketConn.WriteTo(b, udpAddr)
-}
-
-const (
-	tcpKeepAlivePeriod = 30 * time.Second
-)
-
-// setKeepAlive sets tcp keepalive option for tcp connection.
-func setKeepAlive(c net.Conn) {
-	if tcp, ok := c.(*net.TCPConn); ok {
-		err := tcp.SetKeepAlive(true)
-
-		if err != nil {
-			log.Infof("[Direct] failed to set keepalive: %v", err)
-		}
-		err = tcp.SetKeepAlivePeriod(tcpKeepAlivePeriod)
-		if err != nil {
-			log.Infof("[Direct] failed to set keepalive period: %v", err)
-		}
-
+		return nil, err
 	}
+	return newRelayPacketConn(c), nil
 }
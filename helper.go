@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"regexp"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/device"
+	"github.com/xjasonlyu/tun2socks/v2/core/device/fdbased"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+// helperArg is the hidden first argument the privileged helper is started
+// with, followed by the tun device it may open.
+const helperArg = "__helper"
+
+// helperFD is the helper's end of the socketpair, passed as its first extra
+// file.
+const helperFD = 3
+
+// Helper operations. Anything else is refused.
+const (
+	helperOpenTun      = "open-tun"
+	helperListenDNS    = "listen-dns"
+	helperListenDNSTCP = "listen-dns-tcp"
+	helperHostUp       = "host-up"
+	helperHostDown     = "host-down"
+)
+
+// zoneRe matches the DNS zones the helper accepts. They end up in file names
+// under /etc/resolver, so nothing beyond plain labels is allowed.
+var zoneRe = regexp.MustCompile(`^([A-Za-z0-9_]([A-Za-z0-9_-]{0,62})\.)*[A-Za-z0-9_]([A-Za-z0-9_-]{0,62})\.?$`)
+
+// helperMaxMsg bounds a single helper message.
+const helperMaxMsg = 64 << 10
+
+type helperRequest struct {
+	Op   string            `json:"op"`
+	Host *helperHostParams `json:"host,omitempty"`
+}
+
+// helperHostParams is the part of Opts the helper needs for host-up and
+// host-down. The DNS servers are not part of it, the helper always points
+// the resolver at the local proxy.
+type helperHostParams struct {
+	Device         string   `json:"device"`
+	Interface      string   `json:"interface"`
+	DNSClusterZone string   `json:"dns_cluster_zone"`
+	DNSMode        string   `json:"dns_mode"`
+	DNSZones       []string `json:"dns_zones,omitempty"`
+	Subnets        []string `json:"subnets,omitempty"`
+	ExcludeSubnets []string `json:"exclude_subnets,omitempty"`
+	// AllowRouteConflicts is --allow-route-conflicts, the helper checks the
+	// subnets against the host routes itself.
+	AllowRouteConflicts bool `json:"allow_route_conflicts,omitempty"`
+}
+
+type helperResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+func newHelperHostParams(opt *Opts) *helperHostParams {
+	return &helperHostParams{
+		Device:         opt.Device,
+		Interface:      opt.Interface,
+		DNSClusterZone: opt.DNSClusterZone,
+		DNSMode:        opt.DNSMode,
+		DNSZones:       opt.DNSZones,
+		Subnets:        opt.Subnets,
+		ExcludeSubnets: opt.ExcludeSubnets,
+
+		AllowRouteConflicts: opt.AllowRouteConflicts,
+	}
+}
+
+// helper serves the requests of the unprivileged main process. It only acts
+// on the device it was started for and tears the host changes down when the
+// main process goes away.
+type helper struct {
+	device       string
+	host         HostNetwork
+	openTun      func(name string) (int, error)
+	listenDNS    func() (*os.File, error)
+	listenDNSTCP func() (*os.File, error)
+	// up is the configuration applied by host-up, undone on disconnect.
+	up *Opts
+}
+
+// runHelper is the entry point of the privileged helper process.
+func runHelper(device string) {
+	// the terminal signals the whole process group, the helper waits for
+	// the main process to hang up instead
+	signal.Ignore(syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+
+	conn, err := net.FileConn(os.NewFile(helperFD, "helper"))
+	if err != nil {
+		klog.Fatalf("helper: %v", err)
+	}
+	h := &helper{
+		device:  device,
+		host:    newHostNetwork(),
+		openTun: openTunFD,
+		listenDNS: func() (*os.File, error) {
+			pc, err := net.ListenPacket("udp", dnsListenAddr)
+			if err != nil {
+				return nil, err
+			}
+			defer pc.Close()
+			return pc.(*net.UDPConn).File()
+		},
+		listenDNSTCP: func() (*os.File, error) {
+			ln, err := net.Listen("tcp", dnsListenAddr)
+			if err != nil {
+				return nil, err
+			}
+			defer ln.Close()
+			return ln.(*net.TCPListener).File()
+		},
+	}
+	if err := h.serve(conn.(*net.UnixConn)); err != nil {
+		klog.Fatalf("helper: %v", err)
+	}
+}
+
+// serve handles requests until the main process hangs up.
+func (h *helper) serve(conn *net.UnixConn) error {
+	defer conn.Close()
+	for {
+		var req helperRequest
+		if _, err := readHelperMsg(conn, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return h.hangup()
+			}
+			return err
+		}
+
+		fd, err := h.handle(req)
+		var resp helperResponse
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		var fds []int
+		if fd >= 0 {
+			fds = []int{fd}
+		}
+		err = writeHelperMsg(conn, resp, fds...)
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handle runs one request. A returned fd is passed to the main process.
+func (h *helper) handle(req helperRequest) (fd int, err error) {
+	switch req.Op {
+	case helperOpenTun:
+		return h.openTun(h.device)
+	case helperListenDNS, helperListenDNSTCP:
+		listen := h.listenDNS
+		if req.Op == helperListenDNSTCP {
+			listen = h.listenDNSTCP
+		}
+		f, err := listen()
+		if err != nil {
+			return -1, err
+		}
+		defer f.Close()
+		return unix.Dup(int(f.Fd()))
+	case helperHostUp:
+		opt, err := h.hostOpts(req.Host)
+		if err != nil {
+			return -1, err
+		}
+		if h.up != nil {
+			return -1, errors.New("host network already configured")
+		}
+		// the main process is not trusted to have checked the routes
+		subnets, _ := subnetPrefixes(opt)
+		if err := checkRouteConflicts(subnets, opt); err != nil {
+			return -1, err
+		}
+		if err := hostUp(h.host, opt); err != nil {
+			// undo the partial changes so host-up can be retried
+			if !errors.Is(err, errStaleJournal) && journalExists() {
+				err = errors.Join(err, hostDown(h.host, opt))
+			}
+			return -1, err
+		}
+		h.up = opt
+		return -1, nil
+	case helperHostDown:
+		opt, err := h.hostOpts(req.Host)
+		if err != nil {
+			return -1, err
+		}
+		h.up = nil
+		return -1, hostDown(h.host, opt)
+	default:
+		return -1, fmt.Errorf("operation %q not allowed", req.Op)
+	}
+}
+
+// hostOpts validates the parameters of host-up and host-down.
+func (h *helper) hostOpts(p *helperHostParams) (*Opts, error) {
+	if p == nil {
+		return nil, errors.New("missing host parameters")
+	}
+	if deviceName(p.Device) != h.device {
+		return nil, fmt.Errorf("device %q not allowed", p.Device)
+	}
+	if p.DNSMode != dnsModeGlobal && p.DNSMode != dnsModeSplit {
+		return nil, fmt.Errorf("invalid dns mode %q", p.DNSMode)
+	}
+	if _, err := net.InterfaceByName(p.Interface); err != nil {
+		return nil, fmt.Errorf("invalid interface %q: %w", p.Interface, err)
+	}
+	for _, zone := range append([]string{p.DNSClusterZone}, p.DNSZones...) {
+		if !zoneRe.MatchString(zone) {
+			return nil, fmt.Errorf("invalid dns zone %q", zone)
+		}
+	}
+
+	opt := &Opts{
+		Device:         h.device,
+		Interface:      p.Interface,
+		DNSClusterZone: p.DNSClusterZone,
+		DNSMode:        p.DNSMode,
+		DNSZones:       p.DNSZones,
+		Subnets:        p.Subnets,
+		ExcludeSubnets: p.ExcludeSubnets,
+
+		AllowRouteConflicts: p.AllowRouteConflicts,
+	}
+	if _, err := subnetPrefixes(opt); err != nil {
+		return nil, err
+	}
+	return opt, nil
+}
+
+// hangup undoes the host changes left behind by a main process that exited
+// without host-down.
+func (h *helper) hangup() error {
+	if h.up == nil {
+		return nil
+	}
+	klog.Warningf("helper: main process exited, restoring host network")
+	opt := h.up
+	h.up = nil
+	return hostDown(h.host, opt)
+}
+
+// helperClient talks to the privileged helper. It implements HostSetup and
+// opens the tun device and the DNS sockets through it.
+type helperClient struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+// startHelper starts this binary again as the privileged helper for device,
+// connected through a socketpair.
+func startHelper(device string) (*helperClient, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socketpair: %w", err)
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	local, remote := os.NewFile(uintptr(fds[0]), "helper"), os.NewFile(uintptr(fds[1]), "helper")
+	defer remote.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, helperArg, deviceName(device))
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	if err := cmd.Start(); err != nil {
+		local.Close()
+		return nil, fmt.Errorf("failed to start helper: %w", err)
+	}
+	go cmd.Wait()
+
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &helperClient{conn: conn.(*net.UnixConn)}, nil
+}
+
+// call sends req and returns the fd passed with the response, or -1.
+func (c *helperClient) call(req helperRequest) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := writeHelperMsg(c.conn, req); err != nil {
+		return -1, fmt.Errorf("helper %s: %w", req.Op, err)
+	}
+	var resp helperResponse
+	fds, err := readHelperMsg(c.conn, &resp)
+	if err != nil {
+		return -1, fmt.Errorf("helper %s: %w", req.Op, err)
+	}
+	fd := -1
+	for i, f := range fds {
+		if i == 0 {
+			fd = f
+		} else {
+			unix.Close(f)
+		}
+	}
+	if resp.Error != "" {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+		return -1, fmt.Errorf("helper %s: %s", req.Op, resp.Error)
+	}
+	return fd, nil
+}
+
+func (c *helperClient) Up(opt *Opts) error {
+	_, err := c.call(helperRequest{Op: helperHostUp, Host: newHelperHostParams(opt)})
+	return err
+}
+
+func (c *helperClient) Down(opt *Opts) error {
+	_, err := c.call(helperRequest{Op: helperHostDown, Host: newHelperHostParams(opt)})
+	return err
+}
+
+// openDevice replaces openDevice, opening the tun fd the helper created.
+func (c *helperClient) openDevice(s string, mtu uint32) (device.Device, error) {
+	fd, err := c.call(helperRequest{Op: helperOpenTun})
+	if err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return nil, errors.New("helper open-tun: no fd received")
+	}
+	return fdbased.Open(strconv.Itoa(fd), mtu, tunOffset)
+}
+
+// listenDNS replaces listenDNS, using the socket the helper bound.
+func (c *helperClient) listenDNS() (net.PacketConn, error) {
+	fd, err := c.call(helperRequest{Op: helperListenDNS})
+	if err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return nil, errors.New("helper listen-dns: no fd received")
+	}
+	f := os.NewFile(uintptr(fd), "dns")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
+
+// listenDNSTCP replaces listenDNSTCP, using the listener the helper bound.
+func (c *helperClient) listenDNSTCP() (net.Listener, error) {
+	fd, err := c.call(helperRequest{Op: helperListenDNSTCP})
+	if err != nil {
+		return nil, err
+	}
+	if fd < 0 {
+		return nil, errors.New("helper listen-dns-tcp: no fd received")
+	}
+	f := os.NewFile(uintptr(fd), "dns-tcp")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// writeHelperMsg sends v as one JSON line, with fds attached.
+func writeHelperMsg(conn *net.UnixConn, v any, fds ...int) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	_, _, err = conn.WriteMsgUnix(append(data, '\n'), oob, nil)
+	return err
+}
+
+// readHelperMsg reads one JSON line into v and returns the fds that came
+// with it. Only one message is in flight at a time, so a read never runs
+// into the next one.
+func readHelperMsg(conn *net.UnixConn, v any) ([]int, error) {
+	var (
+		data []byte
+		fds  []int
+		buf  = make([]byte, 4096)
+		oob  = make([]byte, unix.CmsgSpace(4*4))
+	)
+	for !bytes.HasSuffix(data, []byte{'\n'}) {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if oobn > 0 {
+			msgs, perr := unix.ParseSocketControlMessage(oob[:oobn])
+			if perr == nil {
+				for i := range msgs {
+					if rights, err := unix.ParseUnixRights(&msgs[i]); err == nil {
+						fds = append(fds, rights...)
+					}
+				}
+			}
+		}
+		if n == 0 && err == nil {
+			err = io.EOF
+		}
+		if err != nil {
+			closeFds(fds)
+			return nil, err
+		}
+		data = append(data, buf[:n]...)
+		if len(data) > helperMaxMsg {
+			closeFds(fds)
+			return nil, errors.New("helper message too large")
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		closeFds(fds)
+		return nil, err
+	}
+	return fds, nil
+}
+
+// closeFds closes the fds of a message that is dropped.
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+// dropPrivileges switches the process to the user that invoked sudo and
+// returns their home directory.
+func dropPrivileges(uid string) (string, error) {
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up user %s: %w", uid, err)
+	}
+	id, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return "", err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return "", err
+	}
+	var groups []int
+	if ids, err := u.GroupIds(); err == nil {
+		for _, g := range ids {
+			if n, err := strconv.Atoi(g); err == nil {
+				groups = append(groups, n)
+			}
+		}
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return "", fmt.Errorf("failed to set groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return "", fmt.Errorf("failed to set gid: %w", err)
+	}
+	if err := syscall.Setuid(id); err != nil {
+		return "", fmt.Errorf("failed to set uid: %w", err)
+	}
+	os.Setenv("HOME", u.HomeDir)
+	os.Setenv("USER", u.Username)
+	return u.HomeDir, nil
+}
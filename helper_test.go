@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func helperPair(t *testing.T) (client, server *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "helper")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+// startTestHelper serves a helper for utun9 backed by h, whose tun device is
+// a pipe. It returns the read end of that pipe and the result of serve.
+func startTestHelper(t *testing.T, h *fakeHost) (*helperClient, *os.File, chan error) {
+	t.Helper()
+	withStateDir(t)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close(); w.Close() })
+
+	client, server := helperPair(t)
+	hp := &helper{
+		device: "utun9",
+		host:   h,
+		openTun: func(name string) (int, error) {
+			return syscall.Dup(int(w.Fd()))
+		},
+		listenDNSTCP: func() (*os.File, error) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return nil, err
+			}
+			defer ln.Close()
+			return ln.(*net.TCPListener).File()
+		},
+	}
+	done := make(chan error, 1)
+	go func() { done <- hp.serve(server) }()
+	t.Cleanup(func() {
+		// wait for the hangup so it does not outlive the state dir
+		client.Close()
+		<-done
+	})
+	return &helperClient{conn: client}, r, done
+}
+
+// withLocalNetwork makes routes the host routes seen by the conflict check.
+// It has to come before the helper is started.
+func withLocalNetwork(t *testing.T, routes []localRoute) {
+	t.Helper()
+	saved := localNetwork
+	localNetwork = func() ([]localRoute, error) { return routes, nil }
+	t.Cleanup(func() { localNetwork = saved })
+}
+
+func testInterface(t *testing.T) string {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil || len(ifaces) == 0 {
+		t.Skip("no network interfaces")
+	}
+	return ifaces[0].Name
+}
+
+func TestReadHelperMsgTooLarge(t *testing.T) {
+	openFds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skipf("cannot count open fds: %v", err)
+		}
+		return len(entries)
+	}
+	client, server := helperPair(t)
+	defer client.Close()
+	defer server.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// an oversized message carrying an fd
+	fd := int(r.Fd())
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		client.WriteMsgUnix([]byte(`{"op":"`), unix.UnixRights(fd), nil)
+		client.Write([]byte(strings.Repeat("x", helperMaxMsg+1)))
+	}()
+	before := openFds()
+	var req helperRequest
+	_, err = readHelperMsg(server, &req)
+	<-written
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("readHelperMsg() error = %v; want too large", err)
+	}
+	if after := openFds(); after != before {
+		t.Errorf("readHelperMsg() left %d received fds open", after-before)
+	}
+}
+
+func TestHelperOpenTun(t *testing.T) {
+	c, r, _ := startTestHelper(t, &fakeHost{})
+
+	fd, err := c.call(helperRequest{Op: helperOpenTun})
+	if err != nil {
+		t.Fatalf("open-tun error = %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "tun")
+	defer f.Close()
+	if _, err := f.Write([]byte("packet")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "packet" {
+		t.Errorf("read = %q, %v; want packet", buf, err)
+	}
+}
+
+func TestHelperListenDNSTCP(t *testing.T) {
+	c, _, _ := startTestHelper(t, &fakeHost{})
+
+	ln, err := c.listenDNSTCP()
+	if err != nil {
+		t.Fatalf("listenDNSTCP() error = %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Write([]byte("query"))
+			conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+	defer conn.Close()
+	if got, err := io.ReadAll(conn); err != nil || string(got) != "query" {
+		t.Errorf("read = %q, %v; want query", got, err)
+	}
+}
+
+func TestHelperRefusesRequests(t *testing.T) {
+	h := &fakeHost{}
+	c, _, _ := startTestHelper(t, h)
+	iface := testInterface(t)
+
+	tests := []struct {
+		req  helperRequest
+		want string
+	}{
+		{helperRequest{Op: "exec"}, "not allowed"},
+		{helperRequest{Op: helperHostUp}, "missing host parameters"},
+		{helperRequest{Op: helperHostUp, Host: &helperHostParams{Device: "utun1", Interface: iface, DNSClusterZone: "cluster.local", DNSMode: dnsModeGlobal}}, "device"},
+		{helperRequest{Op: helperHostUp, Host: &helperHostParams{Device: "utun9", Interface: iface, DNSClusterZone: "cluster.local", DNSMode: "all"}}, "dns mode"},
+		{helperRequest{Op: helperHostUp, Host: &helperHostParams{Device: "utun9", Interface: "nonexistent0", DNSClusterZone: "cluster.local", DNSMode: dnsModeGlobal}}, "interface"},
+		{helperRequest{Op: helperHostUp, Host: &helperHostParams{Device: "utun9", Interface: iface, DNSClusterZone: "cluster.local", DNSMode: dnsModeSplit, DNSZones: []string{"bad zone\n"}}}, "dns zone"},
+		{helperRequest{Op: helperHostDown, Host: &helperHostParams{Device: "utun9", Interface: iface, DNSClusterZone: "cluster.local", DNSMode: dnsModeGlobal, Subnets: []string{"10.0.0.0"}}}, "invalid subnet"},
+	}
+
+	for _, test := range tests {
+		_, err := c.call(test.req)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("call(%+v) error = %v; want %q", test.req, err, test.want)
+		}
+	}
+	if calls := h.recorded(); len(calls) != 0 {
+		t.Errorf("refused requests changed the host: %q", calls)
+	}
+}
+
+func TestHelperRestoresOnHangup(t *testing.T) {
+	withLocalNetwork(t, nil)
+	h := &fakeHost{}
+	c, _, done := startTestHelper(t, h)
+
+	opt := testOpts()
+	opt.Device = "tun://utun9"
+	opt.Interface = testInterface(t)
+	opt.DNSClusterZone = "cluster.local"
+	opt.DNSMode = dnsModeGlobal
+	if err := c.Up(opt); err != nil {
+		t.Fatalf("Up() error = %v", err)
+	}
+	if err := c.Up(opt); err == nil {
+		t.Errorf("second Up() error = nil; want error")
+	}
+	up := h.recorded()
+	if len(up) != 5 {
+		t.Fatalf("Up() calls = %q", up)
+	}
+
+	c.conn.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("serve() error = %v", err)
+	}
+	done <- nil
+	calls := h.recorded()[len(up):]
+	if len(calls) != 4 || calls[len(calls)-1] != "del-address utun9 198.18.0.1/32" {
+		t.Errorf("hangup calls = %q", calls)
+	}
+	if journalExists() {
+		t.Errorf("journal kept after hangup")
+	}
+}
+
+func TestHelperChecksRouteConflicts(t *testing.T) {
+	withLocalNetwork(t, []localRoute{
+		{Dst: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("192.168.1.1"), Interface: "en0"},
+		{Dst: netip.MustParsePrefix("192.168.1.0/24"), Interface: "en0", Connected: true},
+	})
+	h := &fakeHost{}
+	c, _, _ := startTestHelper(t, h)
+
+	opt := testOpts()
+	opt.Interface = testInterface(t)
+	opt.DNSClusterZone = "cluster.local"
+	opt.DNSMode = dnsModeGlobal
+	opt.Subnets = []string{"0.0.0.0/0"}
+	if err := c.Up(opt); err == nil || !strings.Contains(err.Error(), "default route") {
+		t.Fatalf("Up() error = %v; want a default route conflict", err)
+	}
+	if calls := h.recorded(); len(calls) != 0 {
+		t.Errorf("refused Up() changed the host: %q", calls)
+	}
+
+	opt.AllowRouteConflicts = true
+	if err := c.Up(opt); err != nil {
+		t.Fatalf("Up() with --allow-route-conflicts error = %v", err)
+	}
+}
+
+func TestHelperRetriesFailedUp(t *testing.T) {
+	withLocalNetwork(t, nil)
+	h := &fakeHost{fail: map[string]error{opAddRoute: errors.New("denied")}}
+	c, _, _ := startTestHelper(t, h)
+
+	opt := testOpts()
+	opt.Interface = testInterface(t)
+	opt.DNSClusterZone = "cluster.local"
+	opt.DNSMode = dnsModeGlobal
+	if err := c.Up(opt); err == nil {
+		t.Fatalf("Up() error = nil; want error")
+	}
+	if journalExists() {
+		t.Errorf("journal kept after a failed Up()")
+	}
+
+	h.mu.Lock()
+	h.fail = nil
+	h.mu.Unlock()
+	if err := c.Up(opt); err != nil {
+		t.Fatalf("Up() after a failed one error = %v", err)
+	}
+}
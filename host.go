@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// HostNetwork applies the changes kubectl-link makes to the host network
+// configuration. Each supported OS provides its own implementation through
+// newHostNetwork.
+type HostNetwork interface {
+	// AddAddress assigns addr to link and brings it up.
+	AddAddress(link string, addr netip.Prefix) error
+	// DelAddress removes an address assigned by AddAddress.
+	DelAddress(link string, addr netip.Prefix) error
+	// AddRoute routes dst through link.
+	AddRoute(link string, dst netip.Prefix) error
+	// DelRoute removes a route installed by AddRoute.
+	DelRoute(link string, dst netip.Prefix) error
+	// SnapshotDNS captures the resolver configuration SetDNS would change.
+	SnapshotDNS(cfg DNSConfig) (*DNSSnapshot, error)
+	// SetDNS points the host resolver at the DNS proxy.
+	SetDNS(cfg DNSConfig) error
+	// RestoreDNS reverts the change made by SetDNS to snap. A nil snap
+	// falls back to a best-effort reset.
+	RestoreDNS(cfg DNSConfig, snap *DNSSnapshot) error
+}
+
+// HostSetup applies the host changes of a run and undoes them again.
+// localSetup does so in this process, helperClient through the privileged
+// helper.
+type HostSetup interface {
+	Up(opt *Opts) error
+	Down(opt *Opts) error
+}
+
+// localSetup runs hostUp and hostDown on _host.
+type localSetup struct{}
+
+func (localSetup) Up(opt *Opts) error   { return hostUp(_host, opt) }
+func (localSetup) Down(opt *Opts) error { return hostDown(_host, opt) }
+
+// DNSConfig describes the resolver change made by HostNetwork.SetDNS.
+type DNSConfig struct {
+	// Link is the tun device.
+	Link string
+	// Interface is the uplink interface whose resolvers are replaced.
+	Interface string
+	// Servers are the DNS proxy addresses.
+	Servers []netip.Addr
+	// Port is the DNS proxy port.
+	Port uint16
+	// Mode is dnsModeGlobal or dnsModeSplit.
+	Mode string
+	// Domains are sent to the proxy in split mode.
+	Domains []string
+}
+
+// Host network operations reported in HostError.
+const (
+	opAddAddress  = "add-address"
+	opDelAddress  = "del-address"
+	opAddRoute    = "add-route"
+	opDelRoute    = "del-route"
+	opSnapshotDNS = "snapshot-dns"
+	opSetDNS      = "set-dns"
+	opRestoreDNS  = "restore-dns"
+)
+
+// HostError is returned by HostNetwork implementations when a step fails.
+type HostError struct {
+	Op     string
+	Target string
+	Err    error
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Target, e.Err)
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+// CommandError is returned when a helper binary such as ifconfig exits with
+// an error. Output holds whatever the command printed.
+type CommandError struct {
+	Args   []string
+	Output string
+	Err    error
+}
+
+func (e *CommandError) Error() string {
+	out := strings.TrimSpace(e.Output)
+	if out == "" {
+		return fmt.Sprintf("%s: %v", strings.Join(e.Args, " "), e.Err)
+	}
+	return fmt.Sprintf("%s: %v: %s", strings.Join(e.Args, " "), e.Err, out)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// tunAddr is the address assigned to the tun device.
+	tunAddr   = netip.MustParseAddr("198.18.0.1")
+	tunPrefix = netip.PrefixFrom(tunAddr, 32)
+	// tunAddr6 is assigned as well when IPv6 subnets are routed. Like
+	// tunAddr it comes from the benchmarking range.
+	tunAddr6   = netip.MustParseAddr("2001:2::1")
+	tunPrefix6 = netip.PrefixFrom(tunAddr6, 128)
+)
+
+// tunPrefixes returns the addresses to assign to the tun device for the
+// address families in subnets.
+func tunPrefixes(subnets []netip.Prefix) []netip.Prefix {
+	if routesIPv6(subnets) {
+		return []netip.Prefix{tunPrefix, tunPrefix6}
+	}
+	return []netip.Prefix{tunPrefix}
+}
+
+// dnsConfig builds the DNSConfig for opt.
+func dnsConfig(opt *Opts) DNSConfig {
+	return DNSConfig{
+		Link:      deviceName(opt.Device),
+		Interface: opt.Interface,
+		Servers:   []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		Port:      53,
+		Mode:      opt.DNSMode,
+		Domains:   append([]string{opt.DNSClusterZone}, opt.DNSZones...),
+	}
+}
+
+// subnetPrefixes parses opt.Subnets, skipping empty entries, and carves
+// opt.ExcludeSubnets out of them.
+func subnetPrefixes(opt *Opts) ([]netip.Prefix, error) {
+	prefixes, err := parseSubnets(opt.Subnets)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := parseSubnets(opt.ExcludeSubnets)
+	if err != nil {
+		return nil, err
+	}
+	if len(excludes) == 0 {
+		return prefixes, nil
+	}
+	return excludePrefixes(prefixes, excludes), nil
+}
+
+func parseSubnets(subnets []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, subnet := range subnets {
+		if subnet == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", subnet, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// hostUp saves a snapshot of the host resolvers, assigns the tun address,
+// installs the subnet routes and points the host resolver at the DNS proxy.
+// Every change is journaled before it is applied.
+func hostUp(h HostNetwork, opt *Opts) error {
+	link := deviceName(opt.Device)
+	cfg := dnsConfig(opt)
+
+	subnets, err := subnetPrefixes(opt)
+	if err != nil {
+		return err
+	}
+
+	j, err := createJournal()
+	if err != nil {
+		return err
+	}
+
+	snap, err := h.SnapshotDNS(cfg)
+	if err == nil {
+		err = saveDNSSnapshot(snap)
+	}
+	if err != nil {
+		// nothing is recorded yet, an empty journal would only block the
+		// next run
+		j.close()
+		return errors.Join(err, removeJournal())
+	}
+	defer j.close()
+
+	for _, addr := range tunPrefixes(subnets) {
+		if err := j.record(journalEntry{Op: opAddAddress, Link: link, Prefix: addr}); err != nil {
+			return err
+		}
+		if err := h.AddAddress(link, addr); err != nil {
+			return err
+		}
+	}
+	for _, subnet := range subnets {
+		if err := j.record(journalEntry{Op: opAddRoute, Link: link, Prefix: subnet}); err != nil {
+			return err
+		}
+		if err := h.AddRoute(link, subnet); err != nil {
+			return err
+		}
+	}
+	if err := j.record(journalEntry{Op: opSetDNS, DNS: &cfg}); err != nil {
+		return err
+	}
+	return h.SetDNS(cfg)
+}
+
+// hostDown undoes the journaled changes of hostUp, from this or a crashed
+// run. Without a journal it falls back to undoing what opt describes, and to
+// the routes left on the tun device when no subnets are given. It
+// keeps going after a failed step so that as much as possible is restored,
+// and returns all errors joined.
+func hostDown(h HostNetwork, opt *Opts) error {
+	entries, err := readJournal()
+	if err != nil {
+		return err
+	}
+	if entries != nil {
+		return replayJournal(h, entries)
+	}
+
+	link := deviceName(opt.Device)
+	errs := []error{restoreDNS(h, dnsConfig(opt))}
+
+	subnets, err := subnetPrefixes(opt)
+	if err == nil && len(opt.Subnets) == 0 {
+		subnets, err = linkRoutes(link)
+	}
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, subnet := range subnets {
+		errs = append(errs, h.DelRoute(link, subnet))
+	}
+	return errors.Join(errs...)
+}
+
+// linkRoutes returns the routes on link, without the link-local and
+// multicast ones the kernel adds itself. It is replaced in tests.
+var linkRoutes = func(link string) ([]netip.Prefix, error) {
+	routes, err := localRoutes()
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []netip.Prefix
+	for _, r := range routes {
+		addr := r.Dst.Addr()
+		if r.Interface != link || addr.IsLinkLocalUnicast() || addr.IsMulticast() || r.Dst == tunPrefix || r.Dst == tunPrefix6 {
+			continue
+		}
+		prefixes = append(prefixes, r.Dst)
+	}
+	return prefixes, nil
+}
+
+// restoreDNS restores the saved snapshot and removes it once restored. The
+// snapshot's mode wins over cfg, since --reset may run with other flags than
+// the crashed run.
+func restoreDNS(h HostNetwork, cfg DNSConfig) error {
+	snap, err := loadDNSSnapshot()
+	if err != nil {
+		return err
+	}
+
+	if snap != nil && snap.Mode != "" {
+		cfg.Mode = snap.Mode
+	}
+	if err := h.RestoreDNS(cfg, snap); err != nil {
+		return err
+	}
+	return removeDNSSnapshot()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// resolverDir holds the per-domain resolver files used in split mode.
+const resolverDir = "/etc/resolver"
+
+// darwinHost configures the host with ifconfig, route and networksetup. In
+// split mode DNS goes through /etc/resolver files instead of networksetup.
+type darwinHost struct{}
+
+func newHostNetwork() HostNetwork {
+	return &darwinHost{}
+}
+
+func (h *darwinHost) AddAddress(link string, addr netip.Prefix) error {
+	ip := addr.Addr().String()
+	args := []string{"ifconfig", link, ip, ip, "up"}
+	if addr.Addr().Is6() {
+		args = []string{"ifconfig", link, "inet6", ip, "prefixlen", strconv.Itoa(addr.Bits()), "up"}
+	}
+	if err := run(args...); err != nil {
+		return &HostError{Op: opAddAddress, Target: link, Err: err}
+	}
+	return nil
+}
+
+func (h *darwinHost) DelAddress(link string, addr netip.Prefix) error {
+	// addresses are dropped together with the utun device
+	if _, err := net.InterfaceByName(link); err != nil {
+		return nil
+	}
+	args := []string{"ifconfig", link, "inet", addr.Addr().String(), "-alias"}
+	if addr.Addr().Is6() {
+		args = []string{"ifconfig", link, "inet6", addr.Addr().String(), "delete"}
+	}
+	if err := run(args...); err != nil {
+		return &HostError{Op: opDelAddress, Target: link, Err: err}
+	}
+	return nil
+}
+
+func (h *darwinHost) AddRoute(link string, dst netip.Prefix) error {
+	if err := run(routeArgs("add", link, dst)...); err != nil {
+		return &HostError{Op: opAddRoute, Target: dst.String(), Err: err}
+	}
+	return nil
+}
+
+func (h *darwinHost) DelRoute(link string, dst netip.Prefix) error {
+	// routes are dropped together with the utun device
+	if _, err := net.InterfaceByName(link); err != nil {
+		return nil
+	}
+	if err := run(routeArgs("delete", link, dst)...); err != nil {
+		return &HostError{Op: opDelRoute, Target: dst.String(), Err: err}
+	}
+	return nil
+}
+
+func routeArgs(cmd, link string, dst netip.Prefix) []string {
+	if dst.Addr().Is6() {
+		return []string{"route", "-n", cmd, "-inet6", "-net", dst.String(), "-interface", link}
+	}
+	return []string{"route", "-n", cmd, "-net", dst.String(), "-interface", link}
+}
+
+func (h *darwinHost) SetDNS(cfg DNSConfig) error {
+	if cfg.Mode == dnsModeSplit {
+		if err := writeResolverFiles(resolverDir, cfg.Domains, cfg.Servers, cfg.Port); err != nil {
+			return &HostError{Op: opSetDNS, Target: resolverDir, Err: err}
+		}
+		return nil
+	}
+
+	service, err := hardwarePort(cfg.Interface)
+	if err != nil {
+		return &HostError{Op: opSetDNS, Target: cfg.Interface, Err: err}
+	}
+	args := []string{"networksetup", "-setdnsservers", service}
+	for _, server := range cfg.Servers {
+		args = append(args, server.String())
+	}
+	if err := run(args...); err != nil {
+		return &HostError{Op: opSetDNS, Target: service, Err: err}
+	}
+	return nil
+}
+
+func (h *darwinHost) RestoreDNS(cfg DNSConfig, snap *DNSSnapshot) error {
+	if err := removeResolverFiles(resolverDir); err != nil {
+		return &HostError{Op: opRestoreDNS, Target: resolverDir, Err: err}
+	}
+	if cfg.Mode == dnsModeSplit {
+		return nil
+	}
+
+	if snap == nil {
+		service, err := hardwarePort(cfg.Interface)
+		if err != nil {
+			return &HostError{Op: opRestoreDNS, Target: cfg.Interface, Err: err}
+		}
+		snap = &DNSSnapshot{Services: map[string][]string{service: nil}}
+	}
+
+	for service, servers := range snap.Services {
+		current, err := dnsServers(service)
+		if err != nil {
+			return &HostError{Op: opRestoreDNS, Target: service, Err: err}
+		}
+		if slices.Equal(current, servers) {
+			continue
+		}
+		args := []string{"networksetup", "-setdnsservers", service}
+		if len(servers) == 0 {
+			args = append(args, "empty")
+		}
+		if err := run(append(args, servers...)...); err != nil {
+			return &HostError{Op: opRestoreDNS, Target: service, Err: err}
+		}
+	}
+	return nil
+}
+
+// SnapshotDNS records the DNS servers of every network service, since the
+// service behind cfg.Interface may change while kubectl-link runs.
+func (h *darwinHost) SnapshotDNS(cfg DNSConfig) (*DNSSnapshot, error) {
+	snap := &DNSSnapshot{Mode: cfg.Mode}
+	if cfg.Mode == dnsModeSplit {
+		return snap, nil
+	}
+
+	out, err := output("networksetup", "-listallnetworkservices")
+	if err != nil {
+		return nil, &HostError{Op: opSnapshotDNS, Target: cfg.Interface, Err: err}
+	}
+	snap.Services = make(map[string][]string)
+	for _, service := range parseNetworkServices(out) {
+		servers, err := dnsServers(service)
+		if err != nil {
+			return nil, &HostError{Op: opSnapshotDNS, Target: service, Err: err}
+		}
+		snap.Services[service] = servers
+	}
+	return snap, nil
+}
+
+// dnsServers returns the manually configured DNS servers of service.
+func dnsServers(service string) ([]string, error) {
+	out, err := output("networksetup", "-getdnsservers", service)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSServers(out), nil
+}
+
+// parseDNSServers parses `networksetup -getdnsservers`, which prints one
+// address per line or a sentence when none are set.
+func parseDNSServers(out string) []string {
+	var servers []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if _, err := netip.ParseAddr(line); err == nil {
+			servers = append(servers, line)
+		}
+	}
+	return servers
+}
+
+// parseNetworkServices parses `networksetup -listallnetworkservices`. The
+// first line is a legend and disabled services are prefixed with "*".
+func parseNetworkServices(out string) []string {
+	var services []string
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if i == 0 || line == "" {
+			continue
+		}
+		services = append(services, strings.TrimPrefix(line, "*"))
+	}
+	return services
+}
+
+// hardwarePort returns the networksetup hardware port name for iface, e.g.
+// "Wi-Fi" for en0.
+func hardwarePort(iface string) (string, error) {
+	out, err := output("networksetup", "-listallhardwareports")
+	if err != nil {
+		return "", err
+	}
+	if port, ok := parseHardwarePorts(out)[iface]; ok {
+		return port, nil
+	}
+	return "", fmt.Errorf("no hardware port for interface %s", iface)
+}
+
+// parseHardwarePorts maps device names to hardware port names from the output
+// of `networksetup -listallhardwareports`.
+func parseHardwarePorts(out string) map[string]string {
+	ports := make(map[string]string)
+	var port string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Hardware Port":
+			port = value
+		case "Device":
+			if port != "" {
+				ports[value] = port
+			}
+			port = ""
+		}
+	}
+	return ports
+}
+
+func run(args ...string) error {
+	_, err := output(args...)
+	return err
+}
+
+func output(args ...string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return "", &CommandError{Args: args, Output: string(out), Err: err}
+	}
+	return string(out), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// linuxHost configures the host over netlink. DNS is either handed to
+// systemd-resolved for the tun link (split mode) or written to resolv.conf.
+type linuxHost struct {
+	resolvConf   string
+	dialResolved func() (resolvedBus, error)
+}
+
+func newHostNetwork() HostNetwork {
+	return &linuxHost{
+		resolvConf:   resolvConfPath,
+		dialResolved: dialResolved,
+	}
+}
+
+func (h *linuxHost) AddAddress(link string, addr netip.Prefix) error {
+	l, err := netlink.LinkByName(link)
+	if err != nil {
+		return &HostError{Op: opAddAddress, Target: link, Err: err}
+	}
+	if err := netlink.AddrReplace(l, &netlink.Addr{IPNet: prefixIPNet(addr)}); err != nil {
+		return &HostError{Op: opAddAddress, Target: link, Err: err}
+	}
+	if err := netlink.LinkSetUp(l); err != nil {
+		return &HostError{Op: opAddAddress, Target: link, Err: err}
+	}
+	return nil
+}
+
+func (h *linuxHost) DelAddress(link string, addr netip.Prefix) error {
+	l, err := netlink.LinkByName(link)
+	if err != nil {
+		// addresses are dropped together with the link
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return &HostError{Op: opDelAddress, Target: link, Err: err}
+	}
+	if err := netlink.AddrDel(l, &netlink.Addr{IPNet: prefixIPNet(addr)}); err != nil && !errors.Is(err, unix.EADDRNOTAVAIL) {
+		return &HostError{Op: opDelAddress, Target: link, Err: err}
+	}
+	return nil
+}
+
+func (h *linuxHost) AddRoute(link string, dst netip.Prefix) error {
+	l, err := netlink.LinkByName(link)
+	if err != nil {
+		return &HostError{Op: opAddRoute, Target: dst.String(), Err: err}
+	}
+	if err := netlink.RouteReplace(linkRoute(l, dst)); err != nil {
+		return &HostError{Op: opAddRoute, Target: dst.String(), Err: err}
+	}
+	return nil
+}
+
+func (h *linuxHost) DelRoute(link string, dst netip.Prefix) error {
+	l, err := netlink.LinkByName(link)
+	if err != nil {
+		// routes are dropped together with the link
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return &HostError{Op: opDelRoute, Target: dst.String(), Err: err}
+	}
+	if err := netlink.RouteDel(linkRoute(l, dst)); err != nil && !errors.Is(err, unix.ESRCH) {
+		return &HostError{Op: opDelRoute, Target: dst.String(), Err: err}
+	}
+	return nil
+}
+
+// SetDNS in global mode replaces resolv.conf with one that only lists
+// cfg.Servers. A symlinked resolv.conf (e.g. systemd-resolved's stub) is
+// replaced rather than written through.
+//
+// In split mode the cluster zones are routed to cfg.Servers through
+// systemd-resolved on the tun link. Without resolved a managed block is put
+// in front of the existing resolv.conf entries instead. resolv.conf cannot
+// route by domain, so then every query goes to cfg.Servers first and split
+// mode behaves like global mode.
+func (h *linuxHost) SetDNS(cfg DNSConfig) error {
+	if cfg.Mode == dnsModeSplit {
+		return h.setSplitDNS(cfg)
+	}
+
+	content := resolverMarker + "\n"
+	for _, server := range cfg.Servers {
+		content += fmt.Sprintf("nameserver %s\n", server)
+	}
+	if err := os.Remove(h.resolvConf); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return &HostError{Op: opSetDNS, Target: h.resolvConf, Err: err}
+	}
+	if err := os.WriteFile(h.resolvConf, []byte(content), 0644); err != nil {
+		return &HostError{Op: opSetDNS, Target: h.resolvConf, Err: err}
+	}
+	return nil
+}
+
+func (h *linuxHost) setSplitDNS(cfg DNSConfig) error {
+	bus, err := h.dialResolved()
+	if err != nil {
+		klog.Warningf("systemd-resolved unavailable (%v), split DNS is not possible: adding nameservers to %s, all queries go through the proxy", err, h.resolvConf)
+		if err := editResolvConf(h.resolvConf, func(content string) string {
+			return addResolvConfBlock(content, cfg.Servers)
+		}); err != nil {
+			return &HostError{Op: opSetDNS, Target: h.resolvConf, Err: err}
+		}
+		return nil
+	}
+	defer bus.Close()
+
+	l, err := netlink.LinkByName(cfg.Link)
+	if err != nil {
+		return &HostError{Op: opSetDNS, Target: cfg.Link, Err: err}
+	}
+	if err := configureResolvedLink(bus, l.Attrs().Index, cfg); err != nil {
+		return &HostError{Op: opSetDNS, Target: cfg.Link, Err: err}
+	}
+	return nil
+}
+
+// SnapshotDNS captures resolv.conf. Per-link resolved settings need no
+// snapshot, the link belongs to kubectl-link.
+func (h *linuxHost) SnapshotDNS(cfg DNSConfig) (*DNSSnapshot, error) {
+	file, err := snapshotFile(h.resolvConf)
+	if err != nil {
+		return nil, &HostError{Op: opSnapshotDNS, Target: h.resolvConf, Err: err}
+	}
+	return &DNSSnapshot{Mode: cfg.Mode, ResolvConf: file}, nil
+}
+
+// RestoreDNS undoes the change SetDNS made in cfg.Mode. resolv.conf is put
+// back exactly as snapshotted; without a snapshot only the managed block can
+// be removed.
+func (h *linuxHost) RestoreDNS(cfg DNSConfig, snap *DNSSnapshot) error {
+	if bus, err := h.dialResolved(); err == nil {
+		defer bus.Close()
+		// link settings are dropped by resolved together with the link
+		if l, err := netlink.LinkByName(cfg.Link); err == nil {
+			if err := bus.RevertLink(l.Attrs().Index); err != nil {
+				return &HostError{Op: opRestoreDNS, Target: cfg.Link, Err: err}
+			}
+		}
+	}
+
+	if snap == nil || snap.ResolvConf == nil {
+		if err := editResolvConf(h.resolvConf, removeResolvConfBlock); err != nil {
+			return &HostError{Op: opRestoreDNS, Target: h.resolvConf, Err: err}
+		}
+		return nil
+	}
+
+	if cfg.Mode == dnsModeSplit {
+		content, err := os.ReadFile(h.resolvConf)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &HostError{Op: opRestoreDNS, Target: h.resolvConf, Err: err}
+		}
+		// resolved handled the zones, resolv.conf was never touched
+		if removeResolvConfBlock(string(content)) == string(content) {
+			return nil
+		}
+	}
+	if err := restoreFile(h.resolvConf, snap.ResolvConf); err != nil {
+		return &HostError{Op: opRestoreDNS, Target: h.resolvConf, Err: err}
+	}
+	return nil
+}
+
+func linkRoute(l netlink.Link, dst netip.Prefix) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: l.Attrs().Index,
+		Dst:       prefixIPNet(dst),
+		Scope:     netlink.SCOPE_LINK,
+	}
+}
+
+func prefixIPNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   p.Addr().AsSlice(),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
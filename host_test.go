@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/xjasonlyu/tun2socks/v2/core/device"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+)
+
+// fakeHost is a HostNetwork that records every call instead of touching the
+// host. Calls whose op is listed in fail return that error.
+type fakeHost struct {
+	mu      sync.Mutex
+	calls   []string
+	fail    map[string]error
+	servers []string
+}
+
+func (f *fakeHost) record(op, target string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, op+" "+target)
+	if err, ok := f.fail[op]; ok {
+		return &HostError{Op: op, Target: target, Err: err}
+	}
+	return nil
+}
+
+func (f *fakeHost) AddAddress(link string, addr netip.Prefix) error {
+	return f.record(opAddAddress, link+" "+addr.String())
+}
+
+func (f *fakeHost) DelAddress(link string, addr netip.Prefix) error {
+	return f.record(opDelAddress, link+" "+addr.String())
+}
+
+func (f *fakeHost) AddRoute(link string, dst netip.Prefix) error {
+	return f.record(opAddRoute, link+" "+dst.String())
+}
+
+func (f *fakeHost) DelRoute(link string, dst netip.Prefix) error {
+	return f.record(opDelRoute, link+" "+dst.String())
+}
+
+func (f *fakeHost) SnapshotDNS(cfg DNSConfig) (*DNSSnapshot, error) {
+	if err := f.record(opSnapshotDNS, cfg.Interface); err != nil {
+		return nil, err
+	}
+	return &DNSSnapshot{Mode: cfg.Mode, Services: map[string][]string{cfg.Interface: f.servers}}, nil
+}
+
+func (f *fakeHost) SetDNS(cfg DNSConfig) error {
+	return f.record(opSetDNS, fmt.Sprintf("%s %v", cfg.Interface, cfg.Servers))
+}
+
+func (f *fakeHost) RestoreDNS(cfg DNSConfig, snap *DNSSnapshot) error {
+	if snap == nil {
+		return f.record(opRestoreDNS, cfg.Interface+" <nil>")
+	}
+	return f.record(opRestoreDNS, fmt.Sprintf("%s %v", cfg.Interface, snap.Services[cfg.Interface]))
+}
+
+// recorded returns the calls so far, for hosts driven from another goroutine.
+func (f *fakeHost) recorded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// fakeDevice is an in-memory device.Device.
+type fakeDevice struct {
+	*channel.Endpoint
+	name string
+}
+
+func (d *fakeDevice) Name() string { return d.name }
+func (d *fakeDevice) Type() string { return "fake" }
+
+func withStateDir(t *testing.T) {
+	t.Helper()
+	prev := stateDir
+	t.Cleanup(func() { stateDir = prev })
+	stateDir = t.TempDir()
+}
+
+func withFakes(t *testing.T, h *fakeHost) {
+	t.Helper()
+	withStateDir(t)
+	prevHost, prevOpen := _host, openDevice
+	t.Cleanup(func() {
+		_host, openDevice = prevHost, prevOpen
+		_defaultOpt, _defaultDevice, _defaultStack = nil, nil, nil
+	})
+	_host = h
+	openDevice = func(s string, mtu uint32) (device.Device, error) {
+		return &fakeDevice{Endpoint: channel.New(16, 1500, ""), name: deviceName(s)}, nil
+	}
+}
+
+func testOpts() *Opts {
+	return &Opts{
+		Device:    "tun://utun9",
+		Interface: "en0",
+		Subnets:   []string{"10.0.0.0/8", "", "172.16.0.0/12"},
+	}
+}
+
+func TestHostUp(t *testing.T) {
+	withStateDir(t)
+	h := &fakeHost{}
+	if err := hostUp(h, testOpts()); err != nil {
+		t.Fatalf("hostUp() error = %v", err)
+	}
+
+	want := []string{
+		"snapshot-dns en0",
+		"add-address utun9 198.18.0.1/32",
+		"add-route utun9 10.0.0.0/8",
+		"add-route utun9 172.16.0.0/12",
+		"set-dns en0 [127.0.0.1]",
+	}
+	if !reflect.DeepEqual(h.calls, want) {
+		t.Errorf("hostUp() calls = %q; want %q", h.calls, want)
+	}
+	if snap, err := loadDNSSnapshot(); err != nil || snap == nil {
+		t.Errorf("loadDNSSnapshot() = %v, %v; want saved snapshot", snap, err)
+	}
+}
+
+func TestHostUpDualStack(t *testing.T) {
+	withStateDir(t)
+	h := &fakeHost{}
+	opt := testOpts()
+	opt.Subnets = []string{"10.244.0.0/16", "fd00:10:244::/56"}
+	if err := hostUp(h, opt); err != nil {
+		t.Fatalf("hostUp() error = %v", err)
+	}
+
+	want := []string{
+		"snapshot-dns en0",
+		"add-address utun9 198.18.0.1/32",
+		"add-address utun9 2001:2::1/128",
+		"add-route utun9 10.244.0.0/16",
+		"add-route utun9 fd00:10:244::/56",
+		"set-dns en0 [127.0.0.1]",
+	}
+	if !reflect.DeepEqual(h.calls, want) {
+		t.Errorf("hostUp() calls = %q; want %q", h.calls, want)
+	}
+}
+
+func TestHostUpError(t *testing.T) {
+	withStateDir(t)
+	errDenied := errors.New("denied")
+	h := &fakeHost{fail: map[string]error{opAddRoute: errDenied}}
+
+	err := hostUp(h, testOpts())
+
+	var hostErr *HostError
+	if !errors.As(err, &hostErr) || hostErr.Op != opAddRoute || !errors.Is(err, errDenied) {
+		t.Fatalf("hostUp() error = %v; want %s HostError", err, opAddRoute)
+	}
+	if len(h.calls) != 3 {
+		t.Errorf("hostUp() continued after failure: %q", h.calls)
+	}
+}
+
+func TestHostUpInvalidSubnet(t *testing.T) {
+	withStateDir(t)
+	h := &fakeHost{}
+	opt := testOpts()
+	opt.Subnets = []string{"10.0.0.0/33"}
+
+	if err := hostUp(h, opt); err == nil {
+		t.Fatalf("hostUp() error = nil; want error")
+	}
+	if len(h.calls) != 0 {
+		t.Errorf("hostUp() changed the host before validating: %q", h.calls)
+	}
+}
+
+func TestHostUpRefusesStaleSnapshot(t *testing.T) {
+	withStateDir(t)
+	stale := &DNSSnapshot{Mode: dnsModeGlobal, Services: map[string][]string{"en0": {"10.0.0.2"}}}
+	if err := saveDNSSnapshot(stale); err != nil {
+		t.Fatal(err)
+	}
+
+	h := &fakeHost{}
+	if err := hostUp(h, testOpts()); !errors.Is(err, errStaleDNSSnapshot) {
+		t.Fatalf("hostUp() error = %v; want %v", err, errStaleDNSSnapshot)
+	}
+	if !reflect.DeepEqual(h.calls, []string{"snapshot-dns en0"}) {
+		t.Errorf("hostUp() changed the host: %q", h.calls)
+	}
+	if snap, _ := loadDNSSnapshot(); !reflect.DeepEqual(snap, stale) {
+		t.Errorf("stale snapshot overwritten: %+v", snap)
+	}
+	if journalExists() {
+		t.Errorf("hostUp() left a journal behind without recording a change")
+	}
+}
+
+func TestHostDownRestoresSnapshot(t *testing.T) {
+	withStateDir(t)
+	h := &fakeHost{servers: []string{"10.0.0.2"}}
+	if err := hostUp(h, testOpts()); err != nil {
+		t.Fatal(err)
+	}
+
+	// --reset runs in a new process with only the default flags
+	h = &fakeHost{fail: map[string]error{opRestoreDNS: errors.New("busy")}}
+	if err := hostDown(h, testOpts()); err == nil {
+		t.Fatalf("hostDown() error = nil; want error")
+	}
+	if snap, _ := loadDNSSnapshot(); snap == nil {
+		t.Fatalf("snapshot removed after failed restore")
+	}
+
+	h = &fakeHost{}
+	if err := hostDown(h, testOpts()); err != nil {
+		t.Fatalf("hostDown() error = %v", err)
+	}
+	if h.calls[0] != "restore-dns en0 [10.0.0.2]" {
+		t.Errorf("hostDown() calls = %q", h.calls)
+	}
+	if snap, _ := loadDNSSnapshot(); snap != nil {
+		t.Errorf("snapshot kept after restore: %+v", snap)
+	}
+}
+
+func TestHostDownContinuesOnError(t *testing.T) {
+	withStateDir(t)
+	errGone := errors.New("gone")
+	h := &fakeHost{fail: map[string]error{opRestoreDNS: errGone}}
+
+	err := hostDown(h, testOpts())
+	if !errors.Is(err, errGone) {
+		t.Fatalf("hostDown() error = %v; want %v", err, errGone)
+	}
+
+	want := []string{
+		"restore-dns en0 <nil>",
+		"del-route utun9 10.0.0.0/8",
+		"del-route utun9 172.16.0.0/12",
+	}
+	if !reflect.DeepEqual(h.calls, want) {
+		t.Errorf("hostDown() calls = %q; want %q", h.calls, want)
+	}
+}
+
+func TestHostDownWithoutSubnets(t *testing.T) {
+	withStateDir(t)
+	saved := linkRoutes
+	linkRoutes = func(link string) ([]netip.Prefix, error) {
+		if link != "utun9" {
+			t.Errorf("linkRoutes(%s); want utun9", link)
+		}
+		return prefixes("10.96.0.0/12", "10.244.0.0/16"), nil
+	}
+	t.Cleanup(func() { linkRoutes = saved })
+
+	// the subnets were discovered by the crashed run, not passed as flags
+	h := &fakeHost{}
+	opt := testOpts()
+	opt.Subnets = nil
+	if err := hostDown(h, opt); err != nil {
+		t.Fatalf("hostDown() error = %v", err)
+	}
+
+	want := []string{
+		"restore-dns en0 <nil>",
+		"del-route utun9 10.96.0.0/12",
+		"del-route utun9 10.244.0.0/16",
+	}
+	if !reflect.DeepEqual(h.calls, want) {
+		t.Errorf("hostDown() calls = %q; want %q", h.calls, want)
+	}
+}
+
+func TestBootNetstackAndStopTun(t *testing.T) {
+	h := &fakeHost{}
+	withFakes(t, h)
+
+	opt := testOpts()
+	InsertOptsTun(opt)
+	if err := bootNetstack(opt); err != nil {
+		t.Fatalf("bootNetstack() error = %v", err)
+	}
+	if len(h.calls) != 5 || h.calls[1] != "add-address utun9 198.18.0.1/32" {
+		t.Fatalf("bootNetstack() calls = %q", h.calls)
+	}
+
+	h.calls = nil
+	StopTun()
+	want := []string{
+		"restore-dns en0 []",
+		"del-route utun9 172.16.0.0/12",
+		"del-route utun9 10.0.0.0/8",
+		"del-address utun9 198.18.0.1/32",
+	}
+	if !reflect.DeepEqual(h.calls, want) {
+		t.Errorf("StopTun() calls = %q; want %q", h.calls, want)
+	}
+	if journalExists() {
+		t.Errorf("journal kept after StopTun()")
+	}
+}
+
+func TestBootNetstackInvalidDevice(t *testing.T) {
+	h := &fakeHost{}
+	withFakes(t, h)
+
+	opt := testOpts()
+	opt.Device = "tun://"
+	if err := bootNetstack(opt); err == nil {
+		t.Fatalf("bootNetstack() error = nil; want error")
+	}
+	if len(h.calls) != 0 {
+		t.Errorf("bootNetstack() changed the host: %q", h.calls)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const journalFile = "journal.jsonl"
+
+// errStaleJournal is returned when a previous run did not shut down cleanly
+// and its host changes have not been undone yet.
+var errStaleJournal = errors.New("found host changes from an earlier run")
+
+// journalEntry is one host change, recorded before it is applied so that a
+// crash at any point leaves enough behind to undo it.
+type journalEntry struct {
+	Op     string       `json:"op"`
+	Link   string       `json:"link,omitempty"`
+	Prefix netip.Prefix `json:"prefix,omitempty"`
+	// DNS is set for opSetDNS. In split mode it also covers the resolver
+	// files and resolved link settings written for DNS.Domains.
+	DNS *DNSConfig `json:"dns,omitempty"`
+}
+
+// journal appends entries to the journal file in the state directory.
+type journal struct {
+	f *os.File
+}
+
+func journalPath() string {
+	return filepath.Join(stateDir, journalFile)
+}
+
+// journalExists reports whether an earlier run left a journal behind.
+func journalExists() bool {
+	_, err := os.Stat(journalPath())
+	return err == nil
+}
+
+// createJournal starts a new journal. It fails with errStaleJournal if one
+// already exists.
+func createJournal() (*journal, error) {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(journalPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("%w at %s, run with --reset to undo them", errStaleJournal, journalPath())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &journal{f: f}, nil
+}
+
+// record durably appends e.
+func (j *journal) record(e journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
+
+// readJournal returns the recorded entries, or nil if there is no journal.
+// A torn last line from a crash mid-write is ignored.
+func readJournal() ([]journalEntry, error) {
+	data, err := os.ReadFile(journalPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []journalEntry{}
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// without a newline the entry was never synced completely
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", journalPath(), err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+func removeJournal() error {
+	if err := os.Remove(journalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// replayJournal undoes the journaled changes in reverse order. It keeps going
+// after a failed step and only removes the journal once everything has been
+// undone. A DNS snapshot is dropped when the DNS was never changed, so it does
+// not block the next run.
+func replayJournal(h HostNetwork, entries []journalEntry) error {
+	var errs []error
+	dnsSet := false
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		switch e.Op {
+		case opAddAddress:
+			errs = append(errs, h.DelAddress(e.Link, e.Prefix))
+		case opAddRoute:
+			errs = append(errs, h.DelRoute(e.Link, e.Prefix))
+		case opSetDNS:
+			dnsSet = true
+			if e.DNS != nil {
+				errs = append(errs, restoreDNS(h, *e.DNS))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("unknown journal op %q", e.Op))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if !dnsSet {
+		if err := removeDNSSnapshot(); err != nil {
+			return err
+		}
+	}
+	return removeJournal()
+}
+
+// confirmCleanup asks the user whether the changes of a crashed run should be
+// undone. Anything but an explicit yes is a no.
+func confirmCleanup(in io.Reader, out io.Writer) bool {
+	fmt.Fprintf(out, "kubectl-link did not shut down cleanly, %s still lists its host changes.\n", journalPath())
+	fmt.Fprint(out, "Undo them now? [y/N] ")
+
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
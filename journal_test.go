@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+	withStateDir(t)
+
+	j, err := createJournal()
+	if err != nil {
+		t.Fatalf("createJournal() error = %v", err)
+	}
+	cfg := DNSConfig{Interface: "en0", Mode: dnsModeSplit, Domains: []string{"cluster.local"}}
+	want := []journalEntry{
+		{Op: opAddAddress, Link: "utun9", Prefix: tunPrefix},
+		{Op: opAddRoute, Link: "utun9", Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+		{Op: opSetDNS, DNS: &cfg},
+	}
+	for _, e := range want {
+		if err := j.record(e); err != nil {
+			t.Fatalf("record() error = %v", err)
+		}
+	}
+	j.close()
+
+	got, err := readJournal()
+	if err != nil {
+		t.Fatalf("readJournal() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readJournal() = %+v; want %+v", got, want)
+	}
+
+	if _, err := createJournal(); !errors.Is(err, errStaleJournal) {
+		t.Errorf("createJournal() error = %v; want %v", err, errStaleJournal)
+	}
+}
+
+func TestReadJournalTornWrite(t *testing.T) {
+	withStateDir(t)
+
+	if entries, err := readJournal(); err != nil || entries != nil {
+		t.Fatalf("readJournal() without journal = %v, %v; want nil, nil", entries, err)
+	}
+
+	content := `{"op":"add-address","link":"utun9","prefix":"198.18.0.1/32"}` + "\n" + `{"op":"add-ro`
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(journalPath(), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readJournal()
+	if err != nil {
+		t.Fatalf("readJournal() error = %v", err)
+	}
+	if len(entries) != 1 || entries[0].Op != opAddAddress {
+		t.Errorf("readJournal() = %+v; want only the complete entry", entries)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	tests := []struct {
+		name        string
+		entries     []journalEntry
+		fail        map[string]error
+		wantCalls   []string
+		wantErr     bool
+		wantJournal bool
+	}{
+		{
+			name: "reverse order",
+			entries: []journalEntry{
+				{Op: opAddAddress, Link: "utun9", Prefix: tunPrefix},
+				{Op: opAddRoute, Link: "utun9", Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+				{Op: opAddRoute, Link: "utun9", Prefix: netip.MustParsePrefix("172.16.0.0/12")},
+				{Op: opSetDNS, DNS: &DNSConfig{Interface: "en0"}},
+			},
+			wantCalls: []string{
+				"restore-dns en0 <nil>",
+				"del-route utun9 172.16.0.0/12",
+				"del-route utun9 10.0.0.0/8",
+				"del-address utun9 198.18.0.1/32",
+			},
+		},
+		{
+			name: "keeps going and keeps the journal on failure",
+			entries: []journalEntry{
+				{Op: opAddAddress, Link: "utun9", Prefix: tunPrefix},
+				{Op: opAddRoute, Link: "utun9", Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+			},
+			fail: map[string]error{opDelRoute: errors.New("busy")},
+			wantCalls: []string{
+				"del-route utun9 10.0.0.0/8",
+				"del-address utun9 198.18.0.1/32",
+			},
+			wantErr:     true,
+			wantJournal: true,
+		},
+		{
+			name:        "unknown op",
+			entries:     []journalEntry{{Op: "format-disk"}},
+			wantErr:     true,
+			wantJournal: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withStateDir(t)
+			j, err := createJournal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			j.close()
+
+			h := &fakeHost{fail: test.fail}
+			err = replayJournal(h, test.entries)
+			if (err != nil) != test.wantErr {
+				t.Errorf("replayJournal() error = %v; wantErr %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(h.calls, test.wantCalls) {
+				t.Errorf("replayJournal() calls = %q; want %q", h.calls, test.wantCalls)
+			}
+			if journalExists() != test.wantJournal {
+				t.Errorf("journalExists() = %v; want %v", journalExists(), test.wantJournal)
+			}
+		})
+	}
+}
+
+func TestReplayJournalDropsUnusedSnapshot(t *testing.T) {
+	withStateDir(t)
+	if err := saveDNSSnapshot(&DNSSnapshot{Mode: dnsModeGlobal}); err != nil {
+		t.Fatal(err)
+	}
+
+	// hostUp stopped before pointing the DNS at the proxy
+	entries := []journalEntry{{Op: opAddAddress, Link: "utun9", Prefix: tunPrefix}}
+	if err := replayJournal(&fakeHost{}, entries); err != nil {
+		t.Fatalf("replayJournal() error = %v", err)
+	}
+	if snap, _ := loadDNSSnapshot(); snap != nil {
+		t.Errorf("snapshot kept without a DNS change: %+v", snap)
+	}
+}
+
+func TestConfirmCleanup(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"y\n", true},
+		{"YES\n", true},
+		{"n\n", false},
+		{"\n", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		if got := confirmCleanup(strings.NewReader(test.input), &out); got != test.want {
+			t.Errorf("confirmCleanup(%q) = %v; want %v", test.input, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// lbRoundRobin hands out the backends in turn.
+	lbRoundRobin = "round-robin"
+	// lbRandom picks a backend at random.
+	lbRandom = "random"
+	// lbLeastConnections picks the backend with the fewest open connections.
+	lbLeastConnections = "least-connections"
+	// lbClientIP sends all connections of a client IP to the same backend.
+	lbClientIP = "client-ip"
+)
+
+func validLBStrategy(strategy string) bool {
+	switch strategy {
+	case lbRoundRobin, lbRandom, lbLeastConnections, lbClientIP:
+		return true
+	}
+	return false
+}
+
+// backend is a pod behind a destination and the port forwarded to on it.
+type backend struct {
+	pod  *v1.Pod
+	port int32
+	// active counts the open connections through the backend.
+	active atomic.Int64
+}
+
+// from is the key of the forward to the backend's pod in _fwdMap. Backends
+// on different ports of a pod share it.
+func (b *backend) from() fromAddr {
+	return podFrom(b.pod)
+}
+
+// backendSet holds the backends of one destination.
+type backendSet struct {
+	backends []*backend
+	next     atomic.Uint64
+	// stale is set when the service or its endpoints changed, the set is
+	// looked up again on the next connection.
+	stale atomic.Bool
+}
+
+// pick chooses the backend for a new connection from client with strategy.
+func (s *backendSet) pick(strategy, client string) *backend {
+	i := s.pickIndex(strategy, client)
+	if i < 0 {
+		return nil
+	}
+	return s.backends[i]
+}
+
+// pickIndex is pick returning the index of the backend, or -1 without
+// backends.
+func (s *backendSet) pickIndex(strategy, client string) int {
+	n := len(s.backends)
+	if n == 0 {
+		return -1
+	}
+
+	switch strategy {
+	case lbRandom:
+		return rand.IntN(n)
+	case lbLeastConnections:
+		best := 0
+		for i, b := range s.backends {
+			if b.active.Load() < s.backends[best].active.Load() {
+				best = i
+			}
+		}
+		return best
+	case lbClientIP:
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		h := fnv.New32a()
+		h.Write([]byte(client))
+		return int(h.Sum32() % uint32(n))
+	default:
+		return int((s.next.Add(1) - 1) % uint64(n))
+	}
+}
+
+// carryOver takes the backends that are still in s from prev, which keeps
+// their connection counts, and the round-robin position.
+func (s *backendSet) carryOver(prev *backendSet) {
+	if prev == nil {
+		return
+	}
+	for i, b := range s.backends {
+		for _, old := range prev.backends {
+			if old.pod.UID == b.pod.UID && old.pod.Name == b.pod.Name && old.port == b.port {
+				s.backends[i] = old
+				break
+			}
+		}
+	}
+	s.next.Store(prev.next.Load())
+}
+
+// dialBackend opens a connection to b through f, the forward to its pod,
+// holding a reference on the forward until it is closed. It fails with
+// errForwardStopped when f was stopped since it was looked up, for example
+// evicted as idle, and the forward has to be looked up again.
+func dialBackend(f *podForward, b *backend) (net.Conn, error) {
+	ref := _fwdMap.acquire(f.from)
+	if ref == nil {
+		return nil, errForwardStopped
+	}
+	if f.closed() {
+		// ref is of the forward that replaced f
+		_fwdMap.release(ref)
+		return nil, errForwardStopped
+	}
+	c, err := f.dial(b.port)
+	if err != nil {
+		_fwdMap.release(ref)
+		return nil, err
+	}
+	return newTrackedConn(c, b, ref), nil
+}
+
+// trackedConn counts as a connection of its backend and holds ref, the
+// reference on the backend's forward taken by dialBackend, until closed.
+type trackedConn struct {
+	net.Conn
+	backend *backend
+	ref     *forwardRef
+	closed  atomic.Bool
+}
+
+func newTrackedConn(c net.Conn, b *backend, ref *forwardRef) *trackedConn {
+	b.active.Add(1)
+	return &trackedConn{Conn: c, backend: b, ref: ref}
+}
+
+func (c *trackedConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.backend.active.Add(-1)
+		_fwdMap.release(c.ref)
+	}
+	return c.Conn.Close()
+}
+
+// CloseWrite keeps half-closes working through the wrapper.
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
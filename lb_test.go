@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testBackendSet(names ...string) *backendSet {
+	set := &backendSet{}
+	for _, name := range names {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		set.backends = append(set.backends, &backend{pod: pod, port: 8080})
+	}
+	return set
+}
+
+func picks(set *backendSet, strategy string, clients ...string) []string {
+	var names []string
+	for _, client := range clients {
+		names = append(names, set.pick(strategy, client).pod.Name)
+	}
+	return names
+}
+
+func TestPickRoundRobin(t *testing.T) {
+	set := testBackendSet("a", "b", "c")
+	got := picks(set, lbRoundRobin, "", "", "", "")
+	want := []string{"a", "b", "c", "a"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("round-robin picks = %v; want %v", got, want)
+		}
+	}
+}
+
+func TestPickRandom(t *testing.T) {
+	set := testBackendSet("a", "b", "c")
+	seen := map[string]bool{}
+	for i := 0; i < 300; i++ {
+		seen[set.pick(lbRandom, "").pod.Name] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("random picks = %v; want all backends", seen)
+	}
+}
+
+func TestPickLeastConnections(t *testing.T) {
+	set := testBackendSet("a", "b", "c")
+	a, b, _ := set.backends[0], set.backends[1], set.backends[2]
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	tracked := newTrackedConn(c1, a, nil)
+	b.active.Add(2)
+
+	if got := set.pick(lbLeastConnections, "").pod.Name; got != "c" {
+		t.Errorf("least-connections pick = %s; want c", got)
+	}
+	tracked.Close()
+	tracked.Close()
+	if a.active.Load() != 0 {
+		t.Errorf("active after close = %d; want 0", a.active.Load())
+	}
+	if got := set.pick(lbLeastConnections, "").pod.Name; got != "a" {
+		t.Errorf("least-connections pick after close = %s; want a", got)
+	}
+}
+
+func TestPickClientIP(t *testing.T) {
+	set := testBackendSet("a", "b", "c", "d")
+	first := set.pick(lbClientIP, "198.18.0.1:40000").pod.Name
+	for _, client := range []string{"198.18.0.1:40001", "198.18.0.1:51234", "198.18.0.1"} {
+		if got := set.pick(lbClientIP, client).pod.Name; got != first {
+			t.Errorf("client-ip pick for %s = %s; want %s", client, got, first)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, client := range []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1", "10.0.0.4:1", "10.0.0.5:1", "10.0.0.6:1", "10.0.0.7:1", "10.0.0.8:1"} {
+		seen[set.pick(lbClientIP, client).pod.Name] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("client-ip picks for different clients = %v; want them spread", seen)
+	}
+}
+
+func TestValidLBStrategy(t *testing.T) {
+	for _, s := range []string{lbRoundRobin, lbRandom, lbLeastConnections, lbClientIP} {
+		if !validLBStrategy(s) {
+			t.Errorf("validLBStrategy(%q) = false", s)
+		}
+	}
+	if validLBStrategy("fastest") || validLBStrategy("") {
+		t.Errorf("validLBStrategy accepted an unknown strategy")
+	}
+	if (&backendSet{}).pick(lbRoundRobin, "") != nil {
+		t.Errorf("pick on an empty set returned a backend")
+	}
+}
+
+// withTestService serves the service web at 10.96.0.20:80 with the ready pods
+// backing it from the cache, on a fresh _fwdMap whose pod connections fail
+// for the pods in down.
+func withTestService(t *testing.T, strategy string, ready []string, down ...string) *fake.Clientset {
+	t.Helper()
+	withConnectPod(t, func(pod *v1.Pod) (httpstream.Connection, error) {
+		if slices.Contains(down, pod.Name) {
+			return nil, errors.New("pod unreachable")
+		}
+		return newFakeConnection(), nil
+	})
+
+	yes := true
+	objects := []runtime.Object{
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: v1.ServiceSpec{
+				ClusterIP: "10.96.0.20",
+				Ports:     []v1.ServicePort{{Port: 80, TargetPort: intstr.FromInt32(8080)}},
+			},
+		},
+		testSlice("web", "web"),
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		ip := fmt.Sprintf("10.244.0.%d", i+1)
+		objects = append(objects, &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name)},
+			Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: ip},
+		})
+		if slices.Contains(ready, name) {
+			slice := objects[1].(*discoveryv1.EndpointSlice)
+			slice.Endpoints = append(slice.Endpoints, testEndpoint(ip, name, &yes, &yes, nil))
+		}
+	}
+
+	client := fake.NewSimpleClientset(objects...)
+	savedCluster, savedStrategy := _cluster, opt.LBStrategy
+	_cluster, opt.LBStrategy = newClusterCache(client), strategy
+	_cluster.onServiceChange(_fwdMap.invalidateSets)
+	_cluster.onPodChange(_fwdMap.podChanged)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		_cluster, opt.LBStrategy = savedCluster, savedStrategy
+	})
+	if err := _cluster.start(ctx); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	return client
+}
+
+func TestLookupBackends(t *testing.T) {
+	yes := true
+	withPort := func(name, ip string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: v1.PodSpec{Containers: []v1.Container{
+				{Name: "app", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+			}},
+			Status: v1.PodStatus{Phase: v1.PodRunning, PodIP: ip},
+		}
+	}
+	// a replica of an older revision without the named port
+	withoutPort := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "old", Namespace: "default"},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "app"}}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.244.0.9"},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.96.0.20",
+			Ports:     []v1.ServicePort{{Port: 80, TargetPort: intstr.FromString("http")}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		pods []*v1.Pod
+		want []string
+	}{
+		{"all pods have the port", []*v1.Pod{withPort("a", "10.244.0.1"), withPort("b", "10.244.0.2")}, []string{"a:8080", "b:8080"}},
+		{"one pod lacks the port", []*v1.Pod{withPort("a", "10.244.0.1"), withoutPort}, []string{"a:8080"}},
+		{"no pod has the port", []*v1.Pod{withoutPort}, nil},
+	}
+	for _, test := range tests {
+		objects := []runtime.Object{svc}
+		var endpoints []discoveryv1.Endpoint
+		for _, pod := range test.pods {
+			objects = append(objects, pod)
+			endpoints = append(endpoints, testEndpoint(pod.Status.PodIP, pod.Name, &yes, &yes, nil))
+		}
+		objects = append(objects, testSlice("web", "web", endpoints...))
+		c := newTestCache(t, objects...)
+
+		set, err := lookupBackends(c, "10.96.0.20", 80)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("lookupBackends(%s): expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("lookupBackends(%s) error = %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, b := range set.backends {
+			got = append(got, fmt.Sprintf("%s:%d", b.pod.Name, b.port))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("lookupBackends(%s) = %v; want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetForwardedServiceFailsOver(t *testing.T) {
+	withTestService(t, lbClientIP, []string{"a", "b", "c"}, "a")
+
+	// a client whose sticky backend is down
+	set, err := lookupBackends(_cluster, "10.96.0.20", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := ""
+	for i := 1; src == "" && i < 256; i++ {
+		if c := fmt.Sprintf("198.18.0.%d:40000", i); set.pick(lbClientIP, c).pod.Name == "a" {
+			src = c
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		b, f, err := GetForwardedService(src, "10.96.0.20:80")
+		if err != nil {
+			t.Fatalf("GetForwardedService() error = %v", err)
+		}
+		if b.pod.Name == "a" || f == nil || b.port != 8080 {
+			t.Errorf("GetForwardedService() = %s:%d; want another backend than a on 8080", b.pod.Name, b.port)
+		}
+	}
+}
+
+func TestGetForwardedServiceFollowsEndpoints(t *testing.T) {
+	client := withTestService(t, lbRoundRobin, []string{"a"})
+	const dst = "10.96.0.20:80"
+	from := fromAddr("tcp://" + dst)
+
+	b, _, err := GetForwardedService("", dst)
+	if err != nil || b.pod.Name != "a" {
+		t.Fatalf("GetForwardedService() = %v, %v; want a", b, err)
+	}
+
+	updateEndpoints := func(endpoints ...discoveryv1.Endpoint) {
+		t.Helper()
+		slice := testSlice("web", "web", endpoints...)
+		if _, err := client.DiscoveryV1().EndpointSlices("default").Update(context.TODO(), slice, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the backends to be invalidated", func() bool {
+			_, ok := _fwdMap.getSet(from)
+			return !ok
+		})
+	}
+
+	// a scale-up adds b, and a keeps its connection count
+	yes, no := true, false
+	updateEndpoints(testEndpoint("10.244.0.1", "a", &yes, &yes, nil), testEndpoint("10.244.0.2", "b", &yes, &yes, nil))
+	seen := map[string]*backend{}
+	for i := 0; i < 2; i++ {
+		b, _, err := GetForwardedService("", dst)
+		if err != nil {
+			t.Fatalf("GetForwardedService() error = %v", err)
+		}
+		seen[b.pod.Name] = b
+	}
+	if len(seen) != 2 {
+		t.Errorf("backends after a scale-up = %v; want a and b", seen)
+	}
+	set, _ := _fwdMap.getSet(from)
+	if set.backends[0] != b {
+		t.Errorf("backend a was replaced, losing its connection count")
+	}
+
+	// a stops being ready
+	updateEndpoints(testEndpoint("10.244.0.1", "a", &no, &yes, nil), testEndpoint("10.244.0.2", "b", &yes, &yes, nil))
+	for i := 0; i < 2; i++ {
+		b, _, err := GetForwardedService("", dst)
+		if err != nil || b.pod.Name != "b" {
+			t.Errorf("GetForwardedService() with a not ready = %v, %v; want b", b, err)
+		}
+	}
+}
+
+func TestDialForwardedAfterEviction(t *testing.T) {
+	withTestService(t, lbRoundRobin, []string{"a"})
+	const dst = "10.96.0.20:80"
+
+	// the forward is evicted as idle between its lookup and the dial
+	b, f, err := GetForwardedService("", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idle := _fwdMap.evictIdle(0); len(idle) != 1 {
+		t.Fatalf("evictIdle() = %v; want the forward to a", idle)
+	}
+	if _, err := dialBackend(f, b); !errors.Is(err, errForwardStopped) {
+		t.Errorf("dialBackend() through an evicted forward = %v; want errForwardStopped", err)
+	}
+
+	c, err := dialForwarded("", dst)
+	if err != nil {
+		t.Fatalf("dialForwarded() error = %v", err)
+	}
+	defer c.Close()
+	if cur, ok := _fwdMap.get(b.from()); !ok || cur == f {
+		t.Errorf("dialForwarded() did not set the forward up again")
+	}
+	if idle := _fwdMap.evictIdle(0); len(idle) != 0 {
+		t.Errorf("evictIdle() = %v; want the forward in use kept", idle)
+	}
+}
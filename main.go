@@ -2,20 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
-	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"os/user"
-	"path"
-	"runtime"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -28,9 +25,8 @@ import (
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/tools/clientcmd"
 
-	"k8s.io/client-go/transport/spdy"
 	"k8s.io/klog"
 )
 
@@ -44,13 +40,24 @@ var (
 )
 
 type Opts struct {
-	Device            string   `yaml:"device"`
-	Tun2SocksLogLevel string   `yaml:"tun2socks_log_level"`
-	Interface         string   `yaml:"interface"`
-	DNSPod            string   `yaml:"dns_pod"`
-	DNSClusterZone    string   `yaml:"dns_cluster_zone"`
-	Subnets           []string `yaml:"subnets"`
-	Reset             bool     `yaml:"reset"`
+	Device              string        `yaml:"device"`
+	Tun2SocksLogLevel   string        `yaml:"tun2socks_log_level"`
+	Interface           string        `yaml:"interface"`
+	DNSPod              string        `yaml:"dns_pod"`
+	DNSClusterZone      string        `yaml:"dns_cluster_zone"`
+	DNSMode             string        `yaml:"dns_mode"`
+	DNSZones            []string      `yaml:"dns_zones"`
+	DNSUpstreams        []string      `yaml:"dns_upstreams"`
+	DNSForward          []string      `yaml:"dns_forward"`
+	Subnets             []string      `yaml:"subnets"`
+	ExcludeSubnets      []string      `yaml:"exclude_subnets"`
+	AllowRouteConflicts bool          `yaml:"allow_route_conflicts"`
+	Reset               bool          `yaml:"reset"`
+	Proxy               string        `yaml:"proxy"`
+	UDPRelayNamespace   string        `yaml:"udp_relay_namespace"`
+	UDPRelayImage       string        `yaml:"udp_relay_image"`
+	LBStrategy          string        `yaml:"lb_strategy"`
+	ForwardIdleTimeout  time.Duration `yaml:"forward_idle_timeout"`
 }
 
 var (
@@ -62,36 +69,49 @@ var (
 	dnsPod         *v1.Pod
 	opt            = new(Opts)
 	_fwdMap        = newFwdMap()
-	_kclient       kubernetes.Interface
+	_cluster       *clusterCache
 	_clientCfg     *rest.Config
+	_host                    = newHostNetwork()
+	_setup         HostSetup = localSetup{}
+	_udpRelay      *udpRelay
+	// _routesIPv6 is set once IPv6 subnets are routed through the tunnel.
+	_routesIPv6 atomic.Bool
 )
 
 func pluginFlags(flags *pflag.FlagSet) {
-	ibytes, err := exec.Command("sh", "-c", "route get default | grep interface | awk '{print $2}'").Output()
+	defaultIface, err := defaultInterface()
 	if err != nil {
 		klog.Fatalf("failed to get default interface: %v", err)
 	}
-	defaultIface := strings.TrimSpace(string(ibytes))
-	flags.StringVar(&opt.Device, "device", "utun123", "Use this device [driver://]name")
-	flags.StringVar(&opt.Interface, "interface", string(defaultIface), "Use network INTERFACE (Linux/MacOS only)")
+	flags.StringVar(&opt.Device, "device", defaultDeviceName, "Use this device [driver://]name")
+	flags.StringVar(&opt.Interface, "interface", defaultIface, "Use network INTERFACE (Linux/MacOS only)")
 	flags.StringVar(&opt.Tun2SocksLogLevel, "tun2socks-log-level", "info", "Log level [debug|info|warn|error|silent]")
 	flags.StringVar(&opt.DNSPod, "dns-pod", "", "DNS pod name")
 	flags.StringVar(&opt.DNSClusterZone, "dns-cluster-zone", "cluster.local", "DNS cluster zone")
-	flags.StringArrayVar(&opt.Subnets, "subnets", []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"}, "Subnets to route through the tunnel")
-	flags.BoolVar(&opt.Reset, "reset", false, "Reset the network stack / dns")
+	flags.StringVar(&opt.DNSMode, "dns-mode", dnsModeGlobal, "DNS mode [global|split], split only sends the cluster zones to the proxy")
+	flags.StringArrayVar(&opt.DNSZones, "dns-zones", nil, "Additional DNS zones to send to the proxy in split mode")
+	flags.StringSliceVar(&opt.DNSUpstreams, "dns-upstream", nil, "DNS servers [ip|ip:port] for names outside the cluster, in order of preference, the host's resolvers when empty")
+	flags.StringArrayVar(&opt.DNSForward, "dns-forward", nil, "Forward a domain to its own DNS servers, e.g. corp.example.com=10.1.1.1,10.1.1.2")
+	flags.StringArrayVar(&opt.Subnets, "subnets", nil, "Subnets to route through the tunnel, discovered from the cluster when empty")
+	flags.StringArrayVar(&opt.ExcludeSubnets, "exclude-subnets", nil, "Subnets to leave out of the routed ones, e.g. a LAN inside a cluster range")
+	flags.BoolVar(&opt.AllowRouteConflicts, "allow-route-conflicts", false, "Route subnets even if they take over the default gateway or a local network")
+	flags.BoolVar(&opt.Reset, "reset", false, "Reset the network stack / dns, undoing the host changes of a crashed run")
+	flags.StringVar(&opt.UDPRelayNamespace, "udp-relay-namespace", "default", "Namespace of the pod relaying UDP into the cluster")
+	flags.StringVar(&opt.UDPRelayImage, "udp-relay-image", "python:3-alpine", "Image of the pod relaying UDP into the cluster, it needs python3")
+	flags.StringVar(&opt.LBStrategy, "lb-strategy", lbRoundRobin, "Strategy to spread connections over service endpoints [round-robin|random|least-connections|client-ip]")
+	flags.DurationVar(&opt.ForwardIdleTimeout, "forward-idle-timeout", 5*time.Minute, "Stop port forwards without connections for this long, 0 keeps them")
+	flags.StringVar(&opt.Proxy, "proxy", "", "Serve a SOCKS5/HTTP proxy on this address instead of a tun device, no root required")
 }
 
 func main() {
-	if runtime.GOOS != "darwin" {
-		klog.Fatalf("only MacOS is supported")
-	}
-	currentUser, err := user.Current()
-	if err != nil {
-		klog.Fatalf("failed to get current user: %v", err)
-	}
-	if currentUser.Uid != "0" {
-		klog.Fatalf("must run as root")
+	if len(os.Args) == 3 && os.Args[1] == helperArg {
+		if !validDevice(os.Args[2]) {
+			klog.Fatalf("helper: invalid device %q", os.Args[2])
+		}
+		runHelper(os.Args[2])
+		return
 	}
+
 	flags := pflag.NewFlagSet("kubectl-link", pflag.ExitOnError)
 	pflag.CommandLine = flags
 
@@ -106,14 +126,45 @@ func main() {
 
 	flags.Parse(os.Args[1:])
 
+	if opt.DNSMode != dnsModeGlobal && opt.DNSMode != dnsModeSplit {
+		klog.Fatalf("invalid dns mode: %s", opt.DNSMode)
+	}
+
+	if !validLBStrategy(opt.LBStrategy) {
+		klog.Fatalf("invalid lb strategy: %s", opt.LBStrategy)
+	}
+
+	if opt.Proxy == "" || opt.Reset {
+		currentUser, err := user.Current()
+		if err != nil {
+			klog.Fatalf("failed to get current user: %v", err)
+		}
+		if currentUser.Uid != "0" {
+			klog.Fatalf("must run as root, or use --proxy")
+		}
+	}
+
 	if opt.Reset {
 		klog.Infof("Resetting network stack")
-		if err := execCommand(preDown); err != nil {
+		if err := hostDown(_host, opt); err != nil {
 			klog.Fatalf("failed to execute pre-down: %v", err)
 		}
 		return
 	}
 
+	if opt.Proxy == "" && journalExists() {
+		if !isTerminal(os.Stdin) || !confirmCleanup(os.Stdin, os.Stderr) {
+			klog.Fatalf("%v at %s, run with --reset to undo them", errStaleJournal, journalPath())
+		}
+		if err := hostDown(_host, opt); err != nil {
+			klog.Fatalf("failed to undo host changes: %v", err)
+		}
+	}
+
+	if uid := os.Getenv("SUDO_UID"); opt.Proxy == "" && uid != "" && uid != "0" {
+		separatePrivileges(flags, configFlags, uid)
+	}
+
 	rawConfig, err := configFlags.ToRawKubeConfigLoader().RawConfig()
 	if err != nil {
 		klog.Fatalf("failed to load kubeconfig: %v", err)
@@ -132,6 +183,14 @@ func main() {
 
 	client := kubernetes.NewForConfigOrDie(_clientCfg)
 
+	klog.Infof("Syncing pods, services and endpoint slices")
+	_cluster = newClusterCache(client)
+	_cluster.onServiceChange(_fwdMap.invalidateSets)
+	_cluster.onPodChange(_fwdMap.podChanged)
+	if err := _cluster.start(context.Background()); err != nil {
+		klog.Fatalf("failed to sync cluster cache: %v", err)
+	}
+
 	if opt.DNSPod != "" {
 		dnsPod, err = getDNSPodByName(client, "kube-system", opt.DNSPod)
 		if err != nil {
@@ -151,53 +210,151 @@ func main() {
 		klog.Fatalf("no running dns pods found")
 	}
 
-	go func() {
-		// Forward port kubectl port-forward -n kube-system pod/coredns-0-a 5300:53
-		err = PodPortForward(_clientCfg, dnsPod, []string{"5300:53"})
-		if err != nil {
-			klog.Fatalf("failed to forward port: %v", err)
-		}
-	}()
+	// the cluster DNS is reached over streams like other destinations, a
+	// lost connection or a replaced DNS pod only fails the queries meanwhile
+	dnsAddr := net.JoinHostPort(dnsPod.Status.PodIP, "53")
+	if opt.DNSPod == "" {
+		dnsAddr = clusterDNSAddr(_cluster, dnsPod)
+	}
+	dnsListener, err := net.Listen("tcp", upstreamAddr)
+	if err != nil {
+		klog.Fatalf("failed to listen for the cluster DNS: %v", err)
+	}
+	go serveClusterDNS(dnsListener, dnsAddr)
 
-	go func() {
-		err := StartDNSProxy()
+	if opt.Proxy == "" {
+		// the host resolvers are captured before the tunnel replaces them
+		_dnsUpstreams, err = configureDNSUpstreams(opt)
 		if err != nil {
-			klog.Fatalf("failed to start dns proxy: %v", err)
+			klog.Fatalf("%v", err)
 		}
-	}()
-
-	// wait for port forward to be ready
-	waitPort("5300")
+		go _dnsUpstreams.checkHealth(dnsHealthInterval, nil)
+		go func() {
+			err := StartDNSProxy()
+			if err != nil {
+				klog.Fatalf("failed to start dns proxy: %v", err)
+			}
+		}()
+	}
 
-	opt.DNSClusterZone = findZone(dnsPod.Status.PodIP)
+	if !flags.Changed("dns-cluster-zone") {
+		opt.DNSClusterZone = findZone(dnsPod.Status.PodIP, opt.DNSClusterZone)
+	}
 
-	_kclient = client
-	InsertOptsTun(opt)
+	if opt.ForwardIdleTimeout > 0 {
+		go _fwdMap.gcIdle(opt.ForwardIdleTimeout, forwardGCInterval(opt.ForwardIdleTimeout), nil)
+	}
 
-	StartTun()
-	defer StopTun()
+	if opt.Proxy != "" {
+		startProxy(client, opt)
+	} else {
+		startTunnel(client, opt)
+		defer StopTun()
+		defer _udpRelay.close()
+	}
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 	<-sigCh
 }
 
-// waitDns checks if the port forward is ready
-func waitPort(port string) {
-	for i := 0; i < 3; i++ {
-		_, err := net.Dial("tcp", "localhost:"+port)
-		if err == nil {
-			break
+// forwardGCInterval checks for idle forwards a few times per timeout, so they
+// are stopped soon after it passes.
+func forwardGCInterval(timeout time.Duration) time.Duration {
+	return max(timeout/4, time.Second)
+}
+
+// startTunnel routes the cluster subnets through the tun device.
+func startTunnel(client kubernetes.Interface, opt *Opts) {
+	if len(opt.Subnets) == 0 {
+		subnets, err := discoverSubnets(context.TODO(), client)
+		if err != nil {
+			klog.Fatalf("failed to discover cluster subnets: %v", err)
+		}
+		if len(subnets) == 0 {
+			klog.Fatalf("no cluster subnets found, set them with --subnets")
 		}
-		time.Sleep(1 * time.Second)
+		for _, subnet := range subnets {
+			opt.Subnets = append(opt.Subnets, subnet.String())
+		}
+		klog.Infof("discovered cluster subnets: %v", opt.Subnets)
+	}
+	subnets, err := subnetPrefixes(opt)
+	if err != nil {
+		klog.Fatalf("%v", err)
+	}
+	if len(subnets) == 0 {
+		klog.Fatalf("no subnets left to route after --exclude-subnets")
+	}
+	if len(opt.ExcludeSubnets) > 0 {
+		klog.Infof("routing subnets: %v", subnets)
 	}
+	if err := checkRouteConflicts(subnets, opt); err != nil {
+		klog.Fatalf("%v", err)
+	}
+	_routesIPv6.Store(routesIPv6(subnets))
+	_udpRelay = &udpRelay{client: client, namespace: opt.UDPRelayNamespace, image: opt.UDPRelayImage}
+	_udpRelay.cleanup(context.TODO())
+	_cluster.onPodChange(_udpRelay.podChanged)
+
+	InsertOptsTun(opt)
 
-	_, err := net.Dial("tcp", "localhost:5300")
+	StartTun()
+}
+
+// startProxy serves the SOCKS5/HTTP proxy. Without a discovered subnet only
+// cluster names, not cluster IPs, go through port forwards.
+func startProxy(client kubernetes.Interface, opt *Opts) {
+	if len(opt.Subnets) == 0 {
+		subnets, err := discoverSubnets(context.TODO(), client)
+		if err != nil {
+			klog.Warningf("failed to discover cluster subnets: %v", err)
+		}
+		for _, subnet := range subnets {
+			opt.Subnets = append(opt.Subnets, subnet.String())
+		}
+	}
+	subnets, err := subnetPrefixes(opt)
 	if err != nil {
-		klog.Fatalf("failed to dial: %v", err)
+		klog.Fatalf("%v", err)
 	}
 
-	klog.Infof("port forward ready")
+	dialer := newClusterDialer(subnets)
+	go func() {
+		if err := ServeProxy(opt.Proxy, dialer.DialContext); err != nil {
+			klog.Fatalf("failed to serve proxy: %v", err)
+		}
+	}()
+}
+
+// separatePrivileges leaves the tun device and the host changes to a
+// privileged helper and continues as the user that invoked sudo, so that
+// client-go and credential plugins never run as root.
+func separatePrivileges(flags *pflag.FlagSet, configFlags *genericclioptions.ConfigFlags, uid string) {
+	client, err := startHelper(opt.Device)
+	if err != nil {
+		klog.Fatalf("failed to start privileged helper: %v", err)
+	}
+	_setup, openDevice = client, client.openDevice
+	listenDNS, listenDNSTCP = client.listenDNS, client.listenDNSTCP
+
+	home, err := dropPrivileges(uid)
+	if err != nil {
+		klog.Fatalf("failed to drop privileges: %v", err)
+	}
+	// the default kubeconfig and cache paths were derived from root's HOME
+	clientcmd.RecommendedConfigDir = filepath.Join(home, clientcmd.RecommendedHomeDir)
+	clientcmd.RecommendedHomeFile = filepath.Join(clientcmd.RecommendedConfigDir, clientcmd.RecommendedFileName)
+	if configFlags.CacheDir != nil && !flags.Changed("cache-dir") {
+		*configFlags.CacheDir = filepath.Join(clientcmd.RecommendedConfigDir, "cache")
+	}
+	klog.Infof("running as uid %s, host changes are made by the privileged helper", uid)
+}
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
 func hasPort(pod *v1.Pod, containerPort int32, protocol v1.Protocol) bool {
@@ -245,104 +402,139 @@ func findHealthyDNSPod(client kubernetes.Interface, namespace string) (*v1.Pod,
 	return nil, fmt.Errorf("no healthy dns pod found")
 }
 
-func PodPortForward(clientCfg *rest.Config, pod *v1.Pod, ports []string) error {
-	targetURL, err := url.Parse(clientCfg.Host)
-	if err != nil {
-		return fmt.Errorf("failed to parse target URL: %w", err)
-	}
-
-	if pod == nil {
-		return fmt.Errorf("pod is nil")
+// GetForwardedService picks a backend of dst for a new connection from src
+// and returns it with the forward to its pod.
+func GetForwardedService(src, dst string) (*backend, *podForward, error) {
+	if dst == "" {
+		return nil, nil, fmt.Errorf("empty destination address")
 	}
 
-	if pod.Name == "" || pod.Namespace == "" {
-		return fmt.Errorf("pod name or namespace is empty")
+	ip, portStr, err := net.SplitHostPort(dst)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to split host port: %w", err)
 	}
 
-	targetURL.Path = path.Join(
-		"/api/v1/namespaces", pod.Namespace, "pods", pod.Name, "portforward",
-	)
-
-	transport, upgrader, err := spdy.RoundTripperFor(clientCfg)
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return fmt.Errorf("failed to create round tripper: %w", err)
+		return nil, nil, fmt.Errorf("failed to convert port: %w", err)
 	}
 
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, targetURL)
+	klog.Infof("Forwarding service: %s", dst)
 
-	forwarder, err := portforward.New(dialer, ports, context.Background().Done(), make(chan struct{}), &klogWriter{}, &klogWriter{})
-	if err != nil {
-		return fmt.Errorf("failed to create port forwarder: %w", err)
+	from := fromAddr("tcp://" + net.JoinHostPort(ip, portStr))
+
+	// Reject destinations that failed recently
+	if err := _fwdMap.failure(from); err != nil {
+		return nil, nil, err
 	}
 
-	if err = forwarder.ForwardPorts(); err != nil {
-		return fmt.Errorf("failed to forward ports: %w", err)
+	// Check if the backends are already known
+	set, ok := _fwdMap.getSet(from)
+	if !ok {
+		// Concurrent connections to a new destination share one lookup
+		v, err, _ := _fwdMap.lookups.Do(string(from), func() (any, error) {
+			prev, ok := _fwdMap.getSet(from)
+			if ok {
+				return prev, nil
+			}
+			set, err := lookupBackends(_cluster, ip, int32(port))
+			if err != nil {
+				ttl := _fwdMap.fail(from, err)
+				klog.Errorf("failed to find backends of %s, retrying in %s: %v", dst, ttl, err)
+				return nil, err
+			}
+			_fwdMap.succeed(from)
+			set.carryOver(prev)
+			_fwdMap.addSet(from, set)
+			return set, nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		set = v.(*backendSet)
 	}
 
-	return nil
+	// Fall back to the next backends while the picked one is unavailable
+	start := set.pickIndex(opt.LBStrategy, src)
+	for i := range set.backends {
+		b := set.backends[(start+i)%len(set.backends)]
+		var f *podForward
+		f, err = forwardPod(b.pod)
+		if err == nil {
+			return b, f, nil
+		}
+		klog.Warningf("backend %s/%s of %s: %v", b.pod.Namespace, b.pod.Name, dst, err)
+	}
+	return nil, nil, err
 }
 
-func GetForwardedService(client kubernetes.Interface, dst string) (net.Addr, error) {
-	if dst == "" {
-		return nil, fmt.Errorf("empty destination address")
+// lookupBackends finds the pods behind ip and the port to forward to on each.
+func lookupBackends(c *clusterCache, ip string, port int32) (*backendSet, error) {
+	pods := findPodsByIP(c, ip)
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("no pod found for %s", ip)
 	}
 
-	ip, portStr, err := net.SplitHostPort(dst)
-	if err != nil {
-		return nil, fmt.Errorf("failed to split host port: %w", err)
+	set := &backendSet{}
+	var errs []error
+	for _, pod := range pods {
+		// Service IPs forward to the service's targetPort. Pods without it,
+		// e.g. halfway through a rollout, are left out.
+		targetPort, err := c.podTargetPort(pod, ip, port, v1.ProtocolTCP)
+		if err != nil {
+			klog.Warningf("skipping backend of %s: %v", ip, err)
+			errs = append(errs, err)
+			continue
+		}
+		set.backends = append(set.backends, &backend{pod: pod, port: targetPort})
 	}
-
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to convert port: %w", err)
+	if len(set.backends) == 0 {
+		return nil, errors.Join(errs...)
 	}
+	return set, nil
+}
 
-	klog.Infof("Forwarding service: %s", dst)
+// forwardPod returns the forward to pod, connecting it on first use.
+func forwardPod(pod *v1.Pod) (*podForward, error) {
+	from := podFrom(pod)
 
-	// Check if the forwarding is already mapped
-	if existingAddr, ok := _fwdMap.get(fromAddr(fmt.Sprintf("tcp://%s:%d", ip, port))); ok {
-		return existingAddr, nil
+	// Reject forwards that are down until they are retried
+	if err := _fwdMap.failure(from); err != nil {
+		return nil, err
 	}
 
-	// Find a free local port for forwarding
-	localPort := _fwdMap.findFreePort()
-	_fwdMap.addPort(localPort)
-
-	// Find the pod by IP
-	pod, err := findPodByIP(client, ip, opt.DNSClusterZone)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find pod by IP: %w", err)
+	// Check if the forwarding is already mapped
+	if f, ok := _fwdMap.get(from); ok {
+		return f, nil
 	}
 
-	// Forward the port
-	go func() {
-		klog.Infof("Forwarding port: %s", localPort)
-		if err := PodPortForward(_clientCfg, pod, []string{fmt.Sprintf("%s:%d", localPort, port)}); err != nil {
-			klog.Errorf("failed to forward port: %v", err)
-			// TODO: if port forward fails, we add a dummy address to prevent further attempts
-			// maybe we should remove it for a retry if port is exposed later
-			_fwdMap.add(fromAddr(fmt.Sprintf("tcp://%s:%d", ip, port)), &net.TCPAddr{
-				IP:   net.IPv4(127, 0, 0, 1),
-				Port: 50001,
-			})
+	// Concurrent connections to a new pod share one forward
+	v, err, _ := _fwdMap.forwards.Do(string(from), func() (any, error) {
+		if f, ok := _fwdMap.get(from); ok {
+			return f, nil
 		}
-	}()
 
-	// Wait for the port forwarding to be ready
-	klog.Infof("Waiting for port: %s", localPort)
-	waitPort(localPort)
+		// Connect to the pod, reconnecting until it is gone
+		f := newPodForward(pod)
+		f.start()
+		err := f.waitReady(forwardReadyTimeout)
+
+		// Map the forward even if it is not up yet, it keeps retrying
+		_fwdMap.add(from, f)
+		if f.closed() {
+			// torn down while starting, e.g. its pod is already gone
+			_fwdMap.forget(from)
+			return nil, errForwardStopped
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	klog.Infof("Port forward ready: %s", localPort)
-	lport, err := strconv.Atoi(localPort)
+		klog.Infof("Forwarding to pod %s/%s", pod.Namespace, pod.Name)
+		return f, nil
+	})
 	if err != nil {
-		klog.Fatalf("failed to convert port: %v", err)
+		return nil, err
 	}
-	localNet := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: lport}
-
-	// Update the forwarding map with the new local address
-	_fwdMap.add(fromAddr(fmt.Sprintf("tcp://%s:%d", ip, port)), localNet)
-
-	klog.Infof("Forwarded service: %s", localNet.String())
-
-	return localNet, nil
+	return v.(*podForward), nil
 }
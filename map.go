@@ -1,10 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"net"
-	"strconv"
+	"slices"
 	"strings"
 	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/utils/clock"
 )
 
 type fromAddr string
@@ -30,36 +36,83 @@ func (f fromAddr) build(proto, addr string) string {
 	return proto + "://" + addr
 }
 
-type used map[string]bool
+// failure is a negative cache entry: connections to its address are
+// rejected until the entry expires.
+type failure struct {
+	err      error
+	until    time.Time
+	failures int
+}
+
+// unavailableError is returned for addresses in the negative cache.
+type unavailableError struct {
+	from  fromAddr
+	retry time.Duration
+	err   error
+}
+
+func (e *unavailableError) Error() string {
+	_, addr := e.from.parse()
+	return fmt.Sprintf("%s unavailable, retrying in %s: %v", addr, e.retry.Round(time.Second), e.err)
+}
 
-func (u used) add(s string) {
-	u[s] = true
+func (e *unavailableError) Unwrap() error {
+	return e.err
 }
 
-func (u used) has(s string) bool {
-	return u[s]
+// forwardRef tracks the use of a port forward for idle collection.
+type forwardRef struct {
+	// refs counts the open connections through the forward.
+	refs     int
+	lastUsed time.Time
+	// pod is the pod forwarded to.
+	pod *v1.Pod
+	// stop tears the forward down, which forgets it.
+	stop func(reason string)
 }
 
 type fwdMap struct {
-	mu    sync.RWMutex
-	data  map[fromAddr]net.Addr
-	ports used
+	mu sync.RWMutex
+	// data holds the forwards to pods.
+	data map[fromAddr]*podForward
+	// sets holds the backends of each destination.
+	sets map[fromAddr]*backendSet
+	// failed is the negative cache of destinations and forwards.
+	failed map[fromAddr]*failure
+	// refs tracks the use of the running forwards.
+	refs map[fromAddr]*forwardRef
+
+	// lookups and forwards coalesce concurrent setups of the same
+	// destination and pod.
+	lookups  singleflight.Group
+	forwards singleflight.Group
+
+	clock clock.WithTicker
+	// retryMin and retryMax bound the TTL of negative cache entries, which
+	// doubles with every failure in a row.
+	retryMin time.Duration
+	retryMax time.Duration
 }
 
 func newFwdMap() *fwdMap {
 	return &fwdMap{
-		data:  make(map[fromAddr]net.Addr),
-		ports: make(used),
+		data:     make(map[fromAddr]*podForward),
+		sets:     make(map[fromAddr]*backendSet),
+		failed:   make(map[fromAddr]*failure),
+		refs:     make(map[fromAddr]*forwardRef),
+		clock:    clock.RealClock{},
+		retryMin: time.Second,
+		retryMax: 5 * time.Minute,
 	}
 }
 
-func (m *fwdMap) add(from fromAddr, to net.Addr) {
+func (m *fwdMap) add(from fromAddr, to *podForward) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.data[from] = to
 }
 
-func (m *fwdMap) get(from fromAddr) (net.Addr, bool) {
+func (m *fwdMap) get(from fromAddr) (*podForward, bool) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
@@ -67,36 +120,186 @@ func (m *fwdMap) get(from fromAddr) (net.Addr, bool) {
 	return to, exists
 }
 
-func (m *fwdMap) addPort(port string) {
+// forget drops the forward from and every backend set using it, so that
+// their destinations are resolved again.
+func (m *fwdMap) forget(from fromAddr) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.ports.add(port)
+	delete(m.data, from)
+	delete(m.failed, from)
+	delete(m.refs, from)
+	for dst, set := range m.sets {
+		for _, b := range set.backends {
+			if b.from() == from {
+				delete(m.sets, dst)
+				break
+			}
+		}
+	}
+}
+
+// fail puts from in the negative cache for err and returns the TTL of the
+// entry.
+func (m *fwdMap) fail(from fromAddr, err error) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.failed[from]
+	if !ok {
+		f = &failure{}
+		m.failed[from] = f
+	}
+	f.err = err
+	f.failures++
+	ttl := m.retryMax
+	if shift := f.failures - 1; shift < 32 && m.retryMin<<shift < m.retryMax {
+		ttl = m.retryMin << shift
+	}
+	f.until = m.clock.Now().Add(ttl)
+	return ttl
 }
 
-func (m *fwdMap) hasPort(port string) bool {
+// failure returns an *unavailableError while from is in the negative cache.
+// Expired entries let a retry through but keep counting failures until
+// succeed is called.
+func (m *fwdMap) failure(from fromAddr) error {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	return m.ports.has(port)
+
+	f, ok := m.failed[from]
+	if !ok {
+		return nil
+	}
+	retry := f.until.Sub(m.clock.Now())
+	if retry <= 0 {
+		return nil
+	}
+	return &unavailableError{from: from, retry: retry, err: f.err}
 }
 
-func (m *fwdMap) findFreePort() string {
+// succeed drops from from the negative cache.
+func (m *fwdMap) succeed(from fromAddr) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	delete(m.failed, from)
+}
 
-	for port := 30000; port < 40000; port++ {
-		portStr := strconv.Itoa(port)
+// track registers the running forward from to pod, which stop tears down.
+func (m *fwdMap) track(from fromAddr, pod *v1.Pod, stop func(reason string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refs[from] = &forwardRef{lastUsed: m.clock.Now(), pod: pod, stop: stop}
+}
 
-		if _, exists := m.ports[portStr]; exists {
-			continue
+// podChanged stops the running forward to the pod named like pod once pod
+// shows it is deleted, evicted, exited or replaced.
+func (m *fwdMap) podChanged(pod *v1.Pod, deleted bool) {
+	m.mu.RLock()
+	ref, ok := m.refs[podFrom(pod)]
+	m.mu.RUnlock()
+	if !ok || ref.pod == nil {
+		return
+	}
+	switch {
+	case deleted && pod.UID == ref.pod.UID:
+		ref.stop("pod deleted")
+	case !deleted && podGone(ref.pod, pod):
+		ref.stop("pod " + podGoneReason(pod))
+	}
+}
+
+// acquire counts a connection opened through the forward from and returns
+// the reference to release it with. It returns nil when from is not
+// running, e.g. evicted since it was looked up.
+func (m *fwdMap) acquire(from fromAddr) *forwardRef {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ref, ok := m.refs[from]
+	if !ok {
+		return nil
+	}
+	ref.refs++
+	ref.lastUsed = m.clock.Now()
+	return ref
+}
+
+// release counts a connection through the forward of ref as closed. A
+// forward replaced under the same address keeps its own count.
+func (m *fwdMap) release(ref *forwardRef) {
+	if ref == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ref.refs > 0 {
+		ref.refs--
+		ref.lastUsed = m.clock.Now()
+	}
+}
+
+// evictIdle stops the forwards without connections for at least timeout and
+// returns their addresses.
+func (m *fwdMap) evictIdle(timeout time.Duration) []fromAddr {
+	m.mu.Lock()
+	var idle []fromAddr
+	var stops []func(string)
+	for from, ref := range m.refs {
+		if ref.refs == 0 && m.clock.Since(ref.lastUsed) >= timeout {
+			idle = append(idle, from)
+			stops = append(stops, ref.stop)
+			// unmapped right away, so it is not acquired while stopping
+			delete(m.refs, from)
+			delete(m.data, from)
 		}
+	}
+	m.mu.Unlock()
+
+	// stop forgets the forward, which takes the lock
+	for _, stop := range stops {
+		stop("idle for " + timeout.String())
+	}
+	return idle
+}
 
-		n, err := net.Listen("tcp", "localhost:"+portStr)
-		if err == nil {
-			_ = n.Close()
-			m.ports.add(portStr)
-			return portStr
+// gcIdle evicts idle forwards every interval until stop is closed.
+func (m *fwdMap) gcIdle(timeout, interval time.Duration, stop <-chan struct{}) {
+	ticker := m.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			m.evictIdle(timeout)
 		}
 	}
+}
+
+func (m *fwdMap) addSet(from fromAddr, set *backendSet) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sets[from] = set
+}
+
+// getSet returns the backends of from and whether they are current. A stale
+// set is returned as well, to carry its state over to the new one.
+func (m *fwdMap) getSet(from fromAddr) (*backendSet, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	set, exists := m.sets[from]
+	return set, exists && !set.stale.Load()
+}
 
-	return ""
+// invalidateSets marks the backends of the destinations at ips as stale.
+func (m *fwdMap) invalidateSets(ips []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for dst, set := range m.sets {
+		_, addr := dst.parse()
+		host, _, err := net.SplitHostPort(addr)
+		if err == nil && slices.Contains(ips, normalizeIP(host)) {
+			set.stale.Store(true)
+		}
+	}
 }
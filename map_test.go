@@ -1,8 +1,12 @@
 package main
 
 import (
-	"net"
+	"errors"
+	"strings"
 	"testing"
+	"time"
+
+	testingclock "k8s.io/utils/clock/testing"
 )
 
 func TestParse(t *testing.T) {
@@ -47,15 +51,174 @@ func TestBuild(t *testing.T) {
 
 func TestAdd(t *testing.T) {
 	m := newFwdMap()
-	to := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
-	m.add(fromAddr("tcp://localhost:1234"), to)
+	to := &podForward{from: fromAddr("pod://default/web-0")}
+	m.add(fromAddr("pod://default/web-0"), to)
 
-	got, ok := m.get(fromAddr("tcp://localhost:1234"))
+	got, ok := m.get(fromAddr("pod://default/web-0"))
 	if !ok {
 		t.Errorf("add() = %v; want %v", got, to)
 	}
 
-	if got.String() != to.String() {
+	if got != to {
 		t.Errorf("add() = %v; want %v", got, to)
 	}
 }
+
+func TestNegativeCache(t *testing.T) {
+	m := newFwdMap()
+	clk := testingclock.NewFakeClock(time.Now())
+	m.clock = clk
+	m.retryMin, m.retryMax = time.Second, 4*time.Second
+
+	from := fromAddr("tcp://10.96.0.20:80")
+	refused := errors.New("connection refused")
+	if err := m.failure(from); err != nil {
+		t.Fatalf("failure() before any failure = %v", err)
+	}
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if ttl := m.fail(from, refused); ttl != want {
+			t.Errorf("fail() ttl = %s; want %s", ttl, want)
+		}
+		err := m.failure(from)
+		var unavailable *unavailableError
+		if !errors.As(err, &unavailable) || !errors.Is(err, refused) {
+			t.Fatalf("failure() = %v; want unavailable wrapping %v", err, refused)
+		}
+		if !strings.Contains(err.Error(), "10.96.0.20:80 unavailable") {
+			t.Errorf("failure() = %q; want the address in it", err)
+		}
+
+		clk.SetTime(clk.Now().Add(want))
+		if err := m.failure(from); err != nil {
+			t.Errorf("failure() after %s = %v; want retry allowed", want, err)
+		}
+	}
+
+	m.succeed(from)
+	if ttl := m.fail(from, refused); ttl != time.Second {
+		t.Errorf("fail() ttl after succeed = %s; want 1s", ttl)
+	}
+	m.forget(from)
+	if err := m.failure(from); err != nil {
+		t.Errorf("failure() after forget = %v", err)
+	}
+}
+
+// trackTestForward tracks a forward that is forgotten when stopped, like a
+// podForward, and reports the stop on stopped.
+func trackTestForward(m *fwdMap, from fromAddr, stopped chan<- fromAddr) {
+	m.add(from, &podForward{from: from})
+	m.track(from, nil, func(string) {
+		m.forget(from)
+		stopped <- from
+	})
+}
+
+func TestEvictIdle(t *testing.T) {
+	m := newFwdMap()
+	clk := testingclock.NewFakeClock(time.Now())
+	m.clock = clk
+	stopped := make(chan fromAddr, 2)
+
+	a, b := fromAddr("pod://default/web-0"), fromAddr("pod://default/web-1")
+	trackTestForward(m, a, stopped)
+	trackTestForward(m, b, stopped)
+	ref := m.acquire(a)
+
+	clk.Step(5 * time.Minute)
+	if idle := m.evictIdle(5 * time.Minute); len(idle) != 1 || idle[0] != b {
+		t.Fatalf("evictIdle() = %v; want [%s]", idle, b)
+	}
+	if <-stopped != b {
+		t.Errorf("evictIdle() stopped the wrong forward")
+	}
+	if _, ok := m.get(b); ok {
+		t.Errorf("evicted forward still mapped")
+	}
+
+	// the idle time counts from the last connection closing
+	clk.Step(time.Hour)
+	m.release(ref)
+	clk.Step(4 * time.Minute)
+	if idle := m.evictIdle(5 * time.Minute); len(idle) != 0 {
+		t.Fatalf("evictIdle() = %v; want none", idle)
+	}
+	clk.Step(time.Minute)
+	if idle := m.evictIdle(5 * time.Minute); len(idle) != 1 || idle[0] != a {
+		t.Fatalf("evictIdle() = %v; want [%s]", idle, a)
+	}
+	<-stopped
+	if _, ok := m.get(a); ok {
+		t.Errorf("evicted forward still mapped")
+	}
+
+	// releasing forgotten or unknown forwards is harmless
+	m.release(ref)
+	m.release(nil)
+	if m.acquire(b) != nil {
+		t.Errorf("acquire() of an evicted forward succeeded")
+	}
+	if idle := m.evictIdle(0); len(idle) != 0 {
+		t.Errorf("evictIdle() after eviction = %v", idle)
+	}
+}
+
+func TestReleaseReplacedForward(t *testing.T) {
+	m := newFwdMap()
+	stopped := make(chan fromAddr, 1)
+	from := fromAddr("pod://default/web-0")
+
+	// a connection through a pod that is then replaced under the same name
+	trackTestForward(m, from, stopped)
+	old := m.acquire(from)
+	m.forget(from)
+	trackTestForward(m, from, stopped)
+	cur := m.acquire(from)
+	if cur == nil || cur == old {
+		t.Fatalf("acquire() of the new forward = %p; want a new reference", cur)
+	}
+
+	// the old connection closing leaves the new forward in use
+	m.release(old)
+	if idle := m.evictIdle(0); len(idle) != 0 {
+		t.Errorf("evictIdle() = %v; want the new forward kept", idle)
+	}
+	m.release(cur)
+	if idle := m.evictIdle(0); len(idle) != 1 {
+		t.Errorf("evictIdle() = %v; want the new forward once idle", idle)
+	}
+}
+
+func TestGCIdle(t *testing.T) {
+	m := newFwdMap()
+	clk := testingclock.NewFakeClock(time.Now())
+	m.clock = clk
+	stopped := make(chan fromAddr, 1)
+	from := fromAddr("pod://default/web-0")
+	trackTestForward(m, from, stopped)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.gcIdle(time.Minute, 15*time.Second, stop)
+		close(done)
+	}()
+	for !clk.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < 4; i++ {
+		clk.Step(15 * time.Second)
+	}
+	select {
+	case got := <-stopped:
+		if got != from {
+			t.Errorf("gcIdle() stopped %s; want %s", got, from)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("gcIdle() did not evict the idle forward")
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/klog"
+)
+
+const (
+	// forwardStableAfter resets the retry backoff once a forward stayed up
+	// this long.
+	forwardStableAfter = time.Minute
+	// forwardReadyTimeout bounds the wait for a new forward to connect.
+	forwardReadyTimeout = 10 * time.Second
+	// forwardDialAttempts bounds the lookups of a forward for one connection
+	// when it is stopped between the lookup and the dial.
+	forwardDialAttempts = 3
+)
+
+// connectPod opens the port-forward connection to a pod, dialPod outside of
+// tests.
+var connectPod = func(pod *v1.Pod) (httpstream.Connection, error) {
+	return dialPod(_clientCfg, pod)
+}
+
+var (
+	errForwardStopped = errors.New("port forward stopped")
+	errLostConnection = errors.New("lost connection to pod")
+)
+
+// podForward is the port-forward connection to one pod, which connections
+// to any of its ports are streams on. It reconnects with backoff when the
+// connection drops, and is torn down once its pod is gone so the next
+// connection re-resolves the destination.
+type podForward struct {
+	// fwd is the map the forward is registered in, _fwdMap outside of tests.
+	fwd     *fwdMap
+	pod     *v1.Pod
+	from    fromAddr
+	connect func() (httpstream.Connection, error)
+
+	mu        sync.Mutex
+	conn      httpstream.Connection
+	requestID atomic.Int64
+
+	// ready is closed when the first connection is up or failed, with the
+	// failure in readyErr.
+	ready     chan struct{}
+	readyErr  error
+	readyOnce sync.Once
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func newPodForward(pod *v1.Pod) *podForward {
+	connect := connectPod
+	return &podForward{
+		fwd:     _fwdMap,
+		pod:     pod,
+		from:    podFrom(pod),
+		connect: func() (httpstream.Connection, error) { return connect(pod) },
+		ready:   make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+// podFrom is the key of the forward to pod in _fwdMap.
+func podFrom(pod *v1.Pod) fromAddr {
+	return fromAddr("pod://" + pod.Namespace + "/" + pod.Name)
+}
+
+// start registers the forward for idle collection and pod changes, and runs
+// it.
+func (f *podForward) start() {
+	f.fwd.track(f.from, f.pod, f.close)
+	go f.run()
+}
+
+// run keeps the connection up until the forward is closed. While it is down
+// the forward is in the negative cache, and the next attempt is made when
+// the entry expires.
+func (f *podForward) run() {
+	for {
+		klog.Infof("Connecting to pod %s/%s", f.pod.Namespace, f.pod.Name)
+		started := f.fwd.clock.Now()
+		conn, err := f.connect()
+		if err == nil {
+			f.setConn(conn)
+			f.markReady(nil)
+			select {
+			case <-f.stop:
+			case <-conn.CloseChan():
+				err = errLostConnection
+			}
+			f.setConn(nil)
+			conn.Close()
+		}
+		if f.closed() {
+			f.markReady(errForwardStopped)
+			return
+		}
+		if f.fwd.clock.Since(started) > forwardStableAfter {
+			f.fwd.succeed(f.from)
+		}
+		delay := f.fwd.fail(f.from, err)
+		f.markReady(f.fwd.failure(f.from))
+		klog.Errorf("port forward to %s/%s down, retrying in %s: %v", f.pod.Namespace, f.pod.Name, delay.Round(time.Millisecond), err)
+		select {
+		case <-f.stop:
+			return
+		case <-f.fwd.clock.After(delay):
+		}
+	}
+}
+
+func (f *podForward) setConn(conn httpstream.Connection) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conn = conn
+}
+
+// dial opens a connection to port on the pod as a new stream pair.
+func (f *podForward) dial(port int32) (net.Conn, error) {
+	f.mu.Lock()
+	conn := f.conn
+	f.mu.Unlock()
+	if conn == nil {
+		if err := f.fwd.failure(f.from); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("port forward to %s/%s is not connected", f.pod.Namespace, f.pod.Name)
+	}
+	return openStream(conn, f.pod, port, f.requestID.Add(1))
+}
+
+// markReady ends the wait for the first connection. Later calls are no-ops.
+func (f *podForward) markReady(err error) {
+	f.readyOnce.Do(func() {
+		f.readyErr = err
+		close(f.ready)
+	})
+}
+
+// waitReady waits until the first connection is up, and returns why it is
+// not otherwise.
+func (f *podForward) waitReady(timeout time.Duration) error {
+	select {
+	case <-f.ready:
+		return f.readyErr
+	case <-time.After(timeout):
+		return fmt.Errorf("port forward to %s/%s not ready after %s", f.pod.Namespace, f.pod.Name, timeout)
+	}
+}
+
+// close stops the forward and drops it and the destinations using it from
+// fwd.
+func (f *podForward) close(reason string) {
+	f.once.Do(func() {
+		klog.Infof("Stopping port forward to %s/%s: %s", f.pod.Namespace, f.pod.Name, reason)
+		close(f.stop)
+		f.fwd.forget(f.from)
+	})
+}
+
+func (f *podForward) closed() bool {
+	select {
+	case <-f.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// podGone reports whether cur no longer serves as the pod forwarded to.
+func podGone(forwarded, cur *v1.Pod) bool {
+	return cur.UID != forwarded.UID ||
+		cur.DeletionTimestamp != nil ||
+		cur.Status.Phase == v1.PodFailed ||
+		cur.Status.Phase == v1.PodSucceeded
+}
+
+func podGoneReason(cur *v1.Pod) string {
+	switch {
+	case cur.DeletionTimestamp != nil:
+		return "terminating"
+	case cur.Status.Reason == "Evicted":
+		return "evicted"
+	case cur.Status.Phase == v1.PodFailed || cur.Status.Phase == v1.PodSucceeded:
+		return "exited"
+	default:
+		return "replaced"
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes/fake"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+func TestPodGone(t *testing.T) {
+	now := metav1.Now()
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", UID: "a"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+
+	tests := []struct {
+		name   string
+		change func(*v1.Pod)
+		gone   bool
+		reason string
+	}{
+		{"running", func(p *v1.Pod) { p.Status.Conditions = nil }, false, ""},
+		{"replaced", func(p *v1.Pod) { p.UID = "b" }, true, "replaced"},
+		{"terminating", func(p *v1.Pod) { p.DeletionTimestamp = &now }, true, "terminating"},
+		{"evicted", func(p *v1.Pod) { p.Status.Phase = v1.PodFailed; p.Status.Reason = "Evicted" }, true, "evicted"},
+		{"completed", func(p *v1.Pod) { p.Status.Phase = v1.PodSucceeded }, true, "exited"},
+	}
+
+	for _, test := range tests {
+		cur := pod.DeepCopy()
+		test.change(cur)
+		if got := podGone(pod, cur); got != test.gone {
+			t.Errorf("podGone(%s) = %v; want %v", test.name, got, test.gone)
+		}
+		if test.gone && podGoneReason(cur) != test.reason {
+			t.Errorf("podGoneReason(%s) = %q; want %q", test.name, podGoneReason(cur), test.reason)
+		}
+	}
+}
+
+// newTestForward forwards to pod over in-memory connections, closed on the
+// changes to the pods in the returned client.
+func newTestForward(t *testing.T, objects ...runtime.Object) (*podForward, *fake.Clientset) {
+	t.Helper()
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "a"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.244.0.5"},
+	}
+	f := newPodForward(pod)
+	f.fwd = newFwdMap()
+	f.connect = func() (httpstream.Connection, error) { return newFakeConnection(), nil }
+	f.fwd.add(f.from, f)
+	f.fwd.addSet("tcp://10.96.0.20:80", &backendSet{backends: []*backend{{pod: pod, port: 8080}}})
+	t.Cleanup(func() { f.close("test done") })
+
+	client := fake.NewSimpleClientset(objects...)
+	c := newClusterCache(client)
+	c.onPodChange(f.fwd.podChanged)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := c.start(ctx); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	return f, client
+}
+
+func startTestForward(t *testing.T, objects ...runtime.Object) (*podForward, *fake.Clientset) {
+	t.Helper()
+	f, client := newTestForward(t, objects...)
+	f.start()
+	return f, client
+}
+
+func waitForgotten(t *testing.T, f *podForward) {
+	t.Helper()
+	select {
+	case <-f.stop:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("forward not closed")
+	}
+	if _, ok := f.fwd.get(f.from); ok {
+		t.Errorf("forward still mapped after its pod is gone")
+	}
+	if _, ok := f.fwd.getSet("tcp://10.96.0.20:80"); ok {
+		t.Errorf("backends still mapped after a backend is gone")
+	}
+}
+
+func TestPodForwardClosesOnDelete(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "a"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+	other := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default", UID: "c"}}
+	f, client := startTestForward(t, pod, other)
+	pods := client.CoreV1().Pods("default")
+
+	// changes of other pods are ignored
+	if err := pods.Delete(context.TODO(), other.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	updated := pod.DeepCopy()
+	updated.Labels = map[string]string{"app": "web"}
+	if _, err := pods.Update(context.TODO(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if f.closed() {
+		t.Fatalf("forward closed by an unrelated change")
+	}
+
+	if err := pods.Delete(context.TODO(), pod.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForgotten(t, f)
+}
+
+func TestPodForwardClosesOnReplace(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "a"}}
+	f, client := startTestForward(t, pod)
+
+	replaced := pod.DeepCopy()
+	replaced.UID = "b"
+	if _, err := client.CoreV1().Pods("default").Update(context.TODO(), replaced, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForgotten(t, f)
+}
+
+func TestPodForwardClosesOnExit(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "a"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}
+	f, client := startTestForward(t, pod)
+
+	evicted := pod.DeepCopy()
+	evicted.Status = v1.PodStatus{Phase: v1.PodFailed, Reason: "Evicted"}
+	if _, err := client.CoreV1().Pods("default").UpdateStatus(context.TODO(), evicted, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForgotten(t, f)
+}
+
+func TestPodForwardReconnects(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "a"}}
+	f, _ := newTestForward(t, pod)
+	f.fwd.retryMin, f.fwd.retryMax = time.Millisecond, 5*time.Millisecond
+
+	var attempts atomic.Int32
+	connected := make(chan *fakeConnection, 2)
+	f.connect = func() (httpstream.Connection, error) {
+		if attempts.Add(1) < 3 {
+			return nil, errors.New("error upgrading connection: pod not running")
+		}
+		conn := newFakeConnection()
+		connected <- conn
+		return conn, nil
+	}
+	go f.run()
+
+	var unavailable *unavailableError
+	if err := f.waitReady(time.Second); !errors.As(err, &unavailable) {
+		t.Errorf("waitReady() after a failed first connect = %v; want unavailable", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		var conn *fakeConnection
+		select {
+		case conn = <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("forward not reconnected after %d attempts", attempts.Load())
+		}
+		if _, ok := f.fwd.get(f.from); !ok {
+			t.Errorf("reconnecting dropped the forward")
+		}
+		// the connection drops and the forward connects again
+		conn.Close()
+	}
+}
+
+func TestPodForwardBackoff(t *testing.T) {
+	f, _ := newTestForward(t)
+	clk := testingclock.NewFakeClock(time.Now())
+	f.fwd.clock = clk
+
+	var attempts atomic.Int32
+	f.connect = func() (httpstream.Connection, error) {
+		attempts.Add(1)
+		return nil, errors.New("error upgrading connection: pod not running")
+	}
+	go f.run()
+
+	// the retries wait 1s, then 2s, on the clock of the forward
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second} {
+		waitFor(t, "the retry to be scheduled", clk.HasWaiters)
+		clk.Step(delay - time.Millisecond)
+		if n := attempts.Load(); n != int32(i+1) || !clk.HasWaiters() {
+			t.Fatalf("forward retried after %d attempts before %s passed", n, delay)
+		}
+		clk.Step(time.Millisecond)
+		waitFor(t, "the forward to retry", func() bool { return attempts.Load() == int32(i+2) })
+	}
+}
+
+func TestPodForwardDial(t *testing.T) {
+	f, _ := newTestForward(t)
+	if _, err := f.dial(8080); err == nil {
+		t.Errorf("dial() before connecting: expected error")
+	}
+
+	conn := newFakeConnection()
+	f.setConn(conn)
+	for _, want := range []string{"1", "2"} {
+		c, err := f.dial(8080)
+		if err != nil {
+			t.Fatalf("dial() error = %v", err)
+		}
+		defer c.Close()
+		errs, data := <-conn.streams, <-conn.streams
+		id := errs.Headers().Get(v1.PortForwardRequestIDHeader)
+		if id != want || data.Headers().Get(v1.PortForwardRequestIDHeader) != id {
+			t.Errorf("dial() request id = %s; want %s on both streams", id, want)
+		}
+	}
+}
+
+// withConnectPod replaces pod connections by connect for the test, on a
+// fresh _fwdMap.
+func withConnectPod(t *testing.T, connect func(*v1.Pod) (httpstream.Connection, error)) {
+	t.Helper()
+	savedMap, savedConnect := _fwdMap, connectPod
+	_fwdMap = newFwdMap()
+	connectPod = connect
+	m := _fwdMap
+	t.Cleanup(func() {
+		m.evictIdle(0)
+		_fwdMap, connectPod = savedMap, savedConnect
+	})
+}
+
+func TestForwardPodCoalesces(t *testing.T) {
+	var connects atomic.Int32
+	release := make(chan struct{})
+	withConnectPod(t, func(*v1.Pod) (httpstream.Connection, error) {
+		connects.Add(1)
+		<-release
+		return newFakeConnection(), nil
+	})
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "a"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.244.0.5"},
+	}
+
+	type result struct {
+		f   *podForward
+		err error
+	}
+	results := make(chan result, 6)
+	for i := 0; i < 6; i++ {
+		go func() {
+			f, err := forwardPod(pod)
+			results <- result{f, err}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	var first *podForward
+	for i := 0; i < 6; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("forwardPod() error = %v", r.err)
+		}
+		if first == nil {
+			first = r.f
+		}
+		if r.f != first {
+			t.Errorf("forwardPod() returned different forwards to one pod")
+		}
+	}
+	if n := connects.Load(); n != 1 {
+		t.Errorf("forwardPod() connected %d times; want 1", n)
+	}
+}
+
+func TestForwardPodFirstConnectFails(t *testing.T) {
+	var connects atomic.Int32
+	withConnectPod(t, func(*v1.Pod) (httpstream.Connection, error) {
+		connects.Add(1)
+		return nil, errors.New("error upgrading connection: pod not running")
+	})
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default", UID: "a"},
+		Status:     v1.PodStatus{Phase: v1.PodRunning, PodIP: "10.244.0.5"},
+	}
+	for i := 0; i < 3; i++ {
+		_, err := forwardPod(pod)
+		var unavailable *unavailableError
+		if !errors.As(err, &unavailable) || !strings.Contains(err.Error(), "pod not running") {
+			t.Fatalf("forwardPod() error = %v; want unavailable with the connect error", err)
+		}
+	}
+	if n := connects.Load(); n != 1 {
+		t.Errorf("forwardPod() connected %d times; want 1 while the failure is cached", n)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog"
+)
+
+// SOCKS5 protocol constants, RFC 1928.
+const (
+	socksVersion          = 0x05
+	socksNoAuth           = 0x00
+	socksNoAcceptable     = 0xff
+	socksCmdConnect       = 0x01
+	socksAtypIPv4         = 0x01
+	socksAtypDomain       = 0x03
+	socksAtypIPv6         = 0x04
+	socksSucceeded        = 0x00
+	socksFailure          = 0x01
+	socksCmdNotAllowed    = 0x07
+	socksAtypNotSupported = 0x08
+)
+
+// proxyDialTimeout bounds setting up a forward for a proxied connection.
+const proxyDialTimeout = 30 * time.Second
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyServer serves SOCKS5 and HTTP proxy requests on one listener, telling
+// them apart by the first byte a client sends.
+type proxyServer struct {
+	dial dialFunc
+}
+
+// ServeProxy runs the unprivileged proxy on addr until the listener fails.
+func ServeProxy(addr string, dial dialFunc) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Starting SOCKS5/HTTP proxy on %s", ln.Addr())
+	return (&proxyServer{dial: dial}).serve(ln)
+}
+
+func (s *proxyServer) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *proxyServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == socksVersion {
+		err = s.handleSOCKS(conn, br)
+	} else {
+		err = s.handleHTTP(conn, br)
+	}
+	if err != nil {
+		klog.V(1).Infof("proxy %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// handleSOCKS serves a SOCKS5 CONNECT without authentication.
+func (s *proxyServer) handleSOCKS(conn net.Conn, br *bufio.Reader) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+	if !strings.ContainsRune(string(methods), socksNoAuth) {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return errors.New("socks: no supported auth method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return err
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return err
+	}
+	if req[1] != socksCmdConnect {
+		writeSOCKSReply(conn, socksCmdNotAllowed)
+		return fmt.Errorf("socks: unsupported command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if req[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return err
+		}
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case socksAtypDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(conn, socksAtypNotSupported)
+		return fmt.Errorf("socks: unsupported address type %d", req[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	upstream, err := s.dialTarget(target)
+	if err != nil {
+		writeSOCKSReply(conn, socksFailure)
+		return err
+	}
+	defer upstream.Close()
+
+	if err := writeSOCKSReply(conn, socksSucceeded); err != nil {
+		return err
+	}
+	relay(conn, br, upstream)
+	return nil
+}
+
+// writeSOCKSReply answers a request with an unspecified bound address.
+func writeSOCKSReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// handleHTTP serves CONNECT tunnels and plain requests with an absolute URI.
+// Plain requests get one request per connection.
+func (s *proxyServer) handleHTTP(conn net.Conn, br *bufio.Reader) error {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return err
+	}
+
+	if req.Method == http.MethodConnect {
+		upstream, err := s.dialTarget(req.Host)
+		if err != nil {
+			writeHTTPError(conn, http.StatusBadGateway, err)
+			return err
+		}
+		defer upstream.Close()
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			return err
+		}
+		relay(conn, br, upstream)
+		return nil
+	}
+
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		writeHTTPError(conn, http.StatusBadRequest, errors.New("absolute http URI required"))
+		return fmt.Errorf("http: bad request URI %q", req.RequestURI)
+	}
+	target := req.URL.Host
+	if req.URL.Port() == "" {
+		target = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	upstream, err := s.dialTarget(target)
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadGateway, err)
+		return err
+	}
+	defer upstream.Close()
+
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	if err := req.Write(upstream); err != nil {
+		return err
+	}
+	_, err = io.Copy(conn, upstream)
+	return err
+}
+
+func writeHTTPError(w io.Writer, code int, err error) {
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nConnection: close\r\n\r\n%v\n", code, http.StatusText(code), err)
+}
+
+func (s *proxyServer) dialTarget(target string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), proxyDialTimeout)
+	defer cancel()
+	return s.dial(ctx, "tcp", target)
+}
+
+// relay copies between the client, whose buffered bytes are read through br,
+// and upstream until both directions are done.
+func relay(conn net.Conn, br *bufio.Reader, upstream net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(upstream, br)
+		if c, ok := upstream.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(conn, upstream)
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+	<-done
+}
+
+// clusterDialer dials cluster addresses through port forwards and everything
+// else directly, so the proxy can be used for all traffic.
+type clusterDialer struct {
+	// subnets are the cluster ranges. IP targets outside them are dialed
+	// directly.
+	subnets []netip.Prefix
+	// cluster answers names in the cluster zone, when set. Others are
+	// resolved through resolver, the DNS port forward.
+	cluster  *clusterCache
+	resolver string
+	// forward dials a cluster address, dialForwarded outside of tests.
+	forward dialFunc
+	direct  net.Dialer
+}
+
+func newClusterDialer(subnets []netip.Prefix) *clusterDialer {
+	return &clusterDialer{
+		subnets:  subnets,
+		cluster:  _cluster,
+		resolver: upstreamAddr,
+		forward: func(_ context.Context, _, addr string) (net.Conn, error) {
+			return dialForwarded("", addr)
+		},
+	}
+}
+
+func (d *clusterDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if d.inCluster(ip) {
+			return d.forward(ctx, network, addr)
+		}
+		return d.direct.DialContext(ctx, network, addr)
+	}
+
+	if !isClusterName(dns.Fqdn(host)) {
+		return d.direct.DialContext(ctx, network, addr)
+	}
+	ip, err := d.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	return d.forward(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+func (d *clusterDialer) inCluster(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, subnet := range d.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchange answers req from the cache or through the DNS port forward.
+func (d *clusterDialer) exchange(req *dns.Msg) (*dns.Msg, error) {
+	if d.cluster != nil {
+		if resp := d.cluster.resolveCluster(req, opt.DNSClusterZone); resp != nil {
+			return resp, nil
+		}
+	}
+	return _dnsPool.exchangeTCP(req, d.resolver)
+}
+
+// resolve looks a cluster name up, preferring IPv4 addresses.
+func (d *clusterDialer) resolve(name string) (netip.Addr, error) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(name), qtype)
+		resp, err := d.exchange(req)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("failed to resolve %s: %w", name, err)
+		}
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				if ip, ok := netip.AddrFromSlice(rr.A); ok {
+					return ip.Unmap(), nil
+				}
+			case *dns.AAAA:
+				if ip, ok := netip.AddrFromSlice(rr.AAAA); ok {
+					return ip, nil
+				}
+			}
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("failed to resolve %s: no addresses", name)
+}
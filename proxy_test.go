@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// echoServer accepts connections and echoes what it reads.
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+// startProxyServer serves a proxyServer that sends every connection to
+// upstream, recording the requested targets.
+func startProxyServer(t *testing.T, upstream string) (addr string, targets func() []string) {
+	var mu sync.Mutex
+	var dialed []string
+	s := &proxyServer{dial: func(ctx context.Context, network, target string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, target)
+		mu.Unlock()
+		return net.Dial(network, upstream)
+	}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve(ln)
+
+	return ln.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), dialed...)
+	}
+}
+
+func TestProxySOCKS5(t *testing.T) {
+	echo := echoServer(t)
+	addr, targets := startProxyServer(t, echo.Addr().String())
+
+	d, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"web.default.svc.cluster.local:80", "10.96.0.10:53", "[fd00::a]:443"} {
+		c, err := d.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("Dial(%s) error = %v", target, err)
+		}
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("read = %q, %v; want ping", buf, err)
+		}
+		c.Close()
+	}
+
+	want := []string{"web.default.svc.cluster.local:80", "10.96.0.10:53", "[fd00::a]:443"}
+	if got := targets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("dialed %q; want %q", got, want)
+	}
+}
+
+func TestProxyHTTPConnect(t *testing.T) {
+	echo := echoServer(t)
+	addr, targets := startProxyServer(t, echo.Addr().String())
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "CONNECT web.default.svc.cluster.local:443 HTTP/1.1\r\nHost: web.default.svc.cluster.local:443\r\n\r\nping")
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d; want 200", resp.StatusCode)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read = %q, %v; want ping", buf, err)
+	}
+	if got := targets(); len(got) != 1 || got[0] != "web.default.svc.cluster.local:443" {
+		t.Errorf("dialed %q; want web.default.svc.cluster.local:443", got)
+	}
+}
+
+func TestProxyHTTPAbsoluteURI(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Connection") != "" {
+			t.Errorf("Proxy-Connection header was forwarded")
+		}
+		io.WriteString(w, r.Host+r.URL.Path)
+	}))
+	defer backend.Close()
+	addr, targets := startProxyServer(t, backend.Listener.Addr().String())
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr})}}
+	resp, err := client.Get("http://web.default.svc.cluster.local/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "web.default.svc.cluster.local/healthz" {
+		t.Errorf("body = %q", body)
+	}
+	if got := targets(); len(got) != 1 || got[0] != "web.default.svc.cluster.local:80" {
+		t.Errorf("dialed %q; want web.default.svc.cluster.local:80", got)
+	}
+}
+
+func TestClusterDialer(t *testing.T) {
+	zone := opt.DNSClusterZone
+	opt.DNSClusterZone = "cluster.local"
+	t.Cleanup(func() { opt.DNSClusterZone = zone })
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("cluster.local.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 5 IN A 10.96.4.2")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: ln, Handler: mux}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	echo := echoServer(t)
+	var forwarded []string
+	d := &clusterDialer{
+		subnets:  prefixes("10.96.0.0/12"),
+		resolver: ln.Addr().String(),
+		forward: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			forwarded = append(forwarded, addr)
+			return net.Dial(network, echo.Addr().String())
+		},
+	}
+
+	for _, target := range []string{"web.default.svc.cluster.local:80", "10.100.0.1:443", echo.Addr().String()} {
+		c, err := d.DialContext(context.TODO(), "tcp", target)
+		if err != nil {
+			t.Fatalf("DialContext(%s) error = %v", target, err)
+		}
+		c.Close()
+	}
+
+	want := []string{"10.96.4.2:80", "10.100.0.1:443"}
+	if !reflect.DeepEqual(forwarded, want) {
+		t.Errorf("forwarded %q; want %q", forwarded, want)
+	}
+	if !d.inCluster(netip.MustParseAddr("::ffff:10.96.0.1")) {
+		t.Errorf("inCluster() = false for a mapped cluster address")
+	}
+}
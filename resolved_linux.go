@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	resolvedName    = "org.freedesktop.resolve1"
+	resolvedPath    = "/org/freedesktop/resolve1"
+	resolvedManager = "org.freedesktop.resolve1.Manager"
+)
+
+// resolvedBus is the part of systemd-resolved's D-Bus API used to route the
+// cluster zones to the proxy through the tun link.
+type resolvedBus interface {
+	SetLinkDNS(ifindex int, servers []netip.Addr) error
+	SetLinkDomains(ifindex int, domains []resolvedDomain) error
+	SetLinkDefaultRoute(ifindex int, enable bool) error
+	RevertLink(ifindex int) error
+	Close() error
+}
+
+// resolvedDomain is a search or routing-only (~domain) entry of a link.
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// resolvedAddress is the (iay) tuple SetLinkDNS expects.
+type resolvedAddress struct {
+	Family  int32
+	Address []byte
+}
+
+// dbusResolved talks to systemd-resolved over the system bus.
+type dbusResolved struct {
+	conn *dbus.Conn
+	obj  dbus.BusObject
+}
+
+// dialResolved connects to systemd-resolved and fails when it is not running.
+func dialResolved() (resolvedBus, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, err
+	}
+
+	var running bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, resolvedName).Store(&running); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !running {
+		conn.Close()
+		return nil, errors.New("systemd-resolved is not running")
+	}
+
+	return &dbusResolved{conn: conn, obj: conn.Object(resolvedName, resolvedPath)}, nil
+}
+
+func (r *dbusResolved) SetLinkDNS(ifindex int, servers []netip.Addr) error {
+	addrs := make([]resolvedAddress, 0, len(servers))
+	for _, server := range servers {
+		family := int32(unix.AF_INET)
+		if server.Is6() {
+			family = unix.AF_INET6
+		}
+		addrs = append(addrs, resolvedAddress{Family: family, Address: server.AsSlice()})
+	}
+	return r.obj.Call(resolvedManager+".SetLinkDNS", 0, int32(ifindex), addrs).Err
+}
+
+func (r *dbusResolved) SetLinkDomains(ifindex int, domains []resolvedDomain) error {
+	return r.obj.Call(resolvedManager+".SetLinkDomains", 0, int32(ifindex), domains).Err
+}
+
+func (r *dbusResolved) SetLinkDefaultRoute(ifindex int, enable bool) error {
+	return r.obj.Call(resolvedManager+".SetLinkDefaultRoute", 0, int32(ifindex), enable).Err
+}
+
+func (r *dbusResolved) RevertLink(ifindex int) error {
+	return r.obj.Call(resolvedManager+".RevertLink", 0, int32(ifindex)).Err
+}
+
+func (r *dbusResolved) Close() error {
+	return r.conn.Close()
+}
+
+// configureResolvedLink sends cfg.Domains to cfg.Servers through the link
+// and keeps every other name on the host's own resolvers.
+func configureResolvedLink(bus resolvedBus, ifindex int, cfg DNSConfig) error {
+	if err := bus.SetLinkDNS(ifindex, cfg.Servers); err != nil {
+		return fmt.Errorf("SetLinkDNS: %w", err)
+	}
+
+	var domains []resolvedDomain
+	for _, domain := range cfg.Domains {
+		if domain = strings.Trim(domain, "."); domain != "" {
+			domains = append(domains, resolvedDomain{Domain: domain, RoutingOnly: true})
+		}
+	}
+	if err := bus.SetLinkDomains(ifindex, domains); err != nil {
+		return fmt.Errorf("SetLinkDomains: %w", err)
+	}
+
+	if err := bus.SetLinkDefaultRoute(ifindex, false); err != nil {
+		return fmt.Errorf("SetLinkDefaultRoute: %w", err)
+	}
+	return nil
+}
+
+const (
+	resolvConfBegin = "# kubectl-link begin"
+	resolvConfEnd   = "# kubectl-link end"
+)
+
+// addResolvConfBlock puts a managed block listing servers in front of the
+// existing resolv.conf content, replacing an earlier block if present.
+func addResolvConfBlock(content string, servers []netip.Addr) string {
+	block := resolvConfBegin + "\n"
+	for _, server := range servers {
+		block += fmt.Sprintf("nameserver %s\n", server)
+	}
+	block += resolvConfEnd + "\n"
+	return block + removeResolvConfBlock(content)
+}
+
+// removeResolvConfBlock strips the managed block written by
+// addResolvConfBlock and leaves everything else untouched.
+func removeResolvConfBlock(content string) string {
+	start := strings.Index(content, resolvConfBegin+"\n")
+	if start < 0 {
+		return content
+	}
+	end := strings.Index(content[start:], resolvConfEnd+"\n")
+	if end < 0 {
+		return content
+	}
+	return content[:start] + content[start+end+len(resolvConfEnd)+1:]
+}
+
+// editResolvConf rewrites path with edit applied to its content.
+func editResolvConf(path string, edit func(string) string) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	updated := edit(string(content))
+	if updated == string(content) {
+		return nil
+	}
+	return os.WriteFile(path, []byte(updated), 0644)
+}
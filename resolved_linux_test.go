@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeBus is a resolvedBus that records calls instead of using D-Bus.
+type fakeBus struct {
+	calls  []string
+	closed bool
+}
+
+func (b *fakeBus) SetLinkDNS(ifindex int, servers []netip.Addr) error {
+	b.calls = append(b.calls, fmt.Sprintf("SetLinkDNS %d %v", ifindex, servers))
+	return nil
+}
+
+func (b *fakeBus) SetLinkDomains(ifindex int, domains []resolvedDomain) error {
+	b.calls = append(b.calls, fmt.Sprintf("SetLinkDomains %d %v", ifindex, domains))
+	return nil
+}
+
+func (b *fakeBus) SetLinkDefaultRoute(ifindex int, enable bool) error {
+	b.calls = append(b.calls, fmt.Sprintf("SetLinkDefaultRoute %d %v", ifindex, enable))
+	return nil
+}
+
+func (b *fakeBus) RevertLink(ifindex int) error {
+	b.calls = append(b.calls, fmt.Sprintf("RevertLink %d", ifindex))
+	return nil
+}
+
+func (b *fakeBus) Close() error {
+	b.closed = true
+	return nil
+}
+
+func splitConfig(link string) DNSConfig {
+	return DNSConfig{
+		Link:    link,
+		Servers: []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		Port:    53,
+		Mode:    dnsModeSplit,
+		Domains: []string{"cluster.local", "", "svc."},
+	}
+}
+
+func TestConfigureResolvedLink(t *testing.T) {
+	bus := &fakeBus{}
+	if err := configureResolvedLink(bus, 7, splitConfig("kubelink0")); err != nil {
+		t.Fatalf("configureResolvedLink() error = %v", err)
+	}
+
+	want := []string{
+		"SetLinkDNS 7 [127.0.0.1]",
+		"SetLinkDomains 7 [{cluster.local true} {svc true}]",
+		"SetLinkDefaultRoute 7 false",
+	}
+	if !reflect.DeepEqual(bus.calls, want) {
+		t.Errorf("calls = %q; want %q", bus.calls, want)
+	}
+}
+
+func TestResolvConfBlock(t *testing.T) {
+	servers := []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+	original := "search corp.internal\nnameserver 10.0.0.2\n"
+
+	added := addResolvConfBlock(original, servers)
+	want := resolvConfBegin + "\nnameserver 127.0.0.1\n" + resolvConfEnd + "\n" + original
+	if added != want {
+		t.Errorf("addResolvConfBlock() = %q; want %q", added, want)
+	}
+	if again := addResolvConfBlock(added, servers); again != added {
+		t.Errorf("addResolvConfBlock() twice = %q; want %q", again, added)
+	}
+	if removed := removeResolvConfBlock(added); removed != original {
+		t.Errorf("removeResolvConfBlock() = %q; want %q", removed, original)
+	}
+	if removed := removeResolvConfBlock(original); removed != original {
+		t.Errorf("removeResolvConfBlock() without block = %q; want %q", removed, original)
+	}
+}
+
+func TestLinuxHostSplitDNSWithoutResolved(t *testing.T) {
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	original := "nameserver 10.0.0.2\n"
+	if err := os.WriteFile(resolvConf, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &linuxHost{
+		resolvConf:   resolvConf,
+		dialResolved: func() (resolvedBus, error) { return nil, errors.New("not running") },
+	}
+
+	snap, err := h.SnapshotDNS(splitConfig("kubelink0"))
+	if err != nil {
+		t.Fatalf("SnapshotDNS() error = %v", err)
+	}
+	if err := h.SetDNS(splitConfig("kubelink0")); err != nil {
+		t.Fatalf("SetDNS() error = %v", err)
+	}
+	got, _ := os.ReadFile(resolvConf)
+	if string(got) != addResolvConfBlock(original, splitConfig("").Servers) {
+		t.Errorf("resolv.conf = %q", got)
+	}
+
+	if err := h.RestoreDNS(splitConfig("kubelink0"), snap); err != nil {
+		t.Fatalf("RestoreDNS() error = %v", err)
+	}
+	got, _ = os.ReadFile(resolvConf)
+	if string(got) != original {
+		t.Errorf("restored resolv.conf = %q; want %q", got, original)
+	}
+}
+
+func TestLinuxHostRestoreDNSRevertsLink(t *testing.T) {
+	bus := &fakeBus{}
+	h := &linuxHost{
+		resolvConf:   filepath.Join(t.TempDir(), "resolv.conf"),
+		dialResolved: func() (resolvedBus, error) { return bus, nil },
+	}
+
+	if err := h.RestoreDNS(splitConfig("lo"), nil); err != nil {
+		t.Fatalf("RestoreDNS() error = %v", err)
+	}
+	if len(bus.calls) != 1 || bus.calls[0] != "RevertLink 1" || !bus.closed {
+		t.Errorf("calls = %q, closed = %v", bus.calls, bus.closed)
+	}
+
+	// links that are already gone are skipped
+	bus.calls = nil
+	if err := h.RestoreDNS(splitConfig("kubelink-missing"), nil); err != nil {
+		t.Fatalf("RestoreDNS() error = %v", err)
+	}
+	if len(bus.calls) != 0 {
+		t.Errorf("calls = %q; want none", bus.calls)
+	}
+}
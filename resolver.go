@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolverMarker is the first line of every resolver file kubectl-link writes,
+// so that cleanup never touches files created by the user or other tools.
+const resolverMarker = "# generated by kubectl-link"
+
+// DNS modes selected with --dns-mode.
+const (
+	// dnsModeGlobal replaces the system resolvers with the proxy.
+	dnsModeGlobal = "global"
+	// dnsModeSplit only sends the cluster zones to the proxy.
+	dnsModeSplit = "split"
+)
+
+// writeResolverFiles creates one resolver(5) file per zone in dir, each
+// pointing at servers on port. Existing files that were not written by
+// kubectl-link are left alone and reported as an error.
+func writeResolverFiles(dir string, zones []string, servers []netip.Addr, port uint16) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	content := resolverMarker + "\n"
+	for _, server := range servers {
+		content += fmt.Sprintf("nameserver %s\n", server)
+	}
+	content += fmt.Sprintf("port %d\n", port)
+
+	for _, zone := range zones {
+		zone = strings.Trim(zone, ".")
+		if zone == "" || strings.ContainsAny(zone, "/\\") {
+			return fmt.Errorf("invalid zone %q", zone)
+		}
+		file := filepath.Join(dir, zone)
+		if owned, err := isResolverFile(file); err != nil {
+			return err
+		} else if !owned {
+			return fmt.Errorf("%s already exists and was not created by kubectl-link", file)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeResolverFiles deletes every resolver file in dir written by
+// kubectl-link. The zones are not needed, since --reset may not know which
+// zone the crashed run detected.
+func removeResolverFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		file := filepath.Join(dir, entry.Name())
+		owned, err := isResolverFile(file)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !owned {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isResolverFile reports whether file is missing or was written by
+// kubectl-link, i.e. whether it is safe to overwrite.
+func isResolverFile(file string) (bool, error) {
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.HasPrefix(content, []byte(resolverMarker+"\n")), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteResolverFiles(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "resolver")
+	servers := []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+
+	if err := writeResolverFiles(dir, []string{"cluster.local", "corp.internal."}, servers, 53); err != nil {
+		t.Fatalf("writeResolverFiles() error = %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "corp.internal"))
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	want := resolverMarker + "\nnameserver 127.0.0.1\nport 53\n"
+	if string(got) != want {
+		t.Errorf("resolver file = %q; want %q", got, want)
+	}
+
+	// rewriting our own files is fine
+	if err := writeResolverFiles(dir, []string{"cluster.local"}, servers, 53); err != nil {
+		t.Errorf("writeResolverFiles() rewrite error = %v", err)
+	}
+}
+
+func TestWriteResolverFilesKeepsForeignFiles(t *testing.T) {
+	dir := t.TempDir()
+	foreign := filepath.Join(dir, "cluster.local")
+	if err := os.WriteFile(foreign, []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeResolverFiles(dir, []string{"cluster.local"}, []netip.Addr{netip.MustParseAddr("127.0.0.1")}, 53); err == nil {
+		t.Fatalf("writeResolverFiles() error = nil; want error")
+	}
+	if got, _ := os.ReadFile(foreign); string(got) != "nameserver 10.0.0.1\n" {
+		t.Errorf("foreign resolver file overwritten: %q", got)
+	}
+}
+
+func TestRemoveResolverFiles(t *testing.T) {
+	dir := t.TempDir()
+	servers := []netip.Addr{netip.MustParseAddr("127.0.0.1")}
+	if err := writeResolverFiles(dir, []string{"cluster.local", "svc"}, servers, 53); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "corp.internal"), []byte("nameserver 10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeResolverFiles(dir); err != nil {
+		t.Fatalf("removeResolverFiles() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "corp.internal" {
+		t.Errorf("remaining files = %v; want only corp.internal", entries)
+	}
+
+	if err := removeResolverFiles(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("removeResolverFiles() on missing dir error = %v", err)
+	}
+}
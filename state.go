@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// stateDir holds the files that let --reset undo host changes after a crash.
+var stateDir = "/var/run/kubectl-link"
+
+const dnsSnapshotFile = "dns.json"
+
+// errStaleDNSSnapshot is returned when a previous run left its DNS snapshot
+// behind. Overwriting it would lose the user's original configuration.
+var errStaleDNSSnapshot = errors.New("found DNS snapshot from an earlier run")
+
+// DNSSnapshot is the host resolver configuration captured before SetDNS.
+type DNSSnapshot struct {
+	// Mode is the DNS mode of the run that took the snapshot.
+	Mode string `json:"mode"`
+	// Services maps macOS network services to their manually configured DNS
+	// servers. An empty list means the servers come from DHCP.
+	Services map[string][]string `json:"services,omitempty"`
+	// ResolvConf is /etc/resolv.conf on Linux.
+	ResolvConf *FileSnapshot `json:"resolvConf,omitempty"`
+}
+
+// FileSnapshot is the content of a file, or the target if it is a symlink.
+type FileSnapshot struct {
+	Missing bool   `json:"missing,omitempty"`
+	Link    string `json:"link,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+func dnsSnapshotPath() string {
+	return filepath.Join(stateDir, dnsSnapshotFile)
+}
+
+// saveDNSSnapshot persists snap. The file is written aside and linked into
+// place, so a crash never leaves a partial snapshot, and an existing one is
+// never replaced.
+func saveDNSSnapshot(snap *DNSSnapshot) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(stateDir, dnsSnapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Link(tmp.Name(), dnsSnapshotPath()); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%w at %s, run with --reset to restore it", errStaleDNSSnapshot, dnsSnapshotPath())
+		}
+		return err
+	}
+	return nil
+}
+
+// loadDNSSnapshot returns the saved snapshot, or nil if there is none.
+func loadDNSSnapshot() (*DNSSnapshot, error) {
+	data, err := os.ReadFile(dnsSnapshotPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snap := new(DNSSnapshot)
+	if err := json.Unmarshal(data, snap); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", dnsSnapshotPath(), err)
+	}
+	return snap, nil
+}
+
+// removeDNSSnapshot deletes the snapshot once it has been restored.
+func removeDNSSnapshot() error {
+	if err := os.Remove(dnsSnapshotPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// snapshotFile captures path for restoreFile.
+func snapshotFile(path string) (*FileSnapshot, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &FileSnapshot{Missing: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		return &FileSnapshot{Link: target}, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSnapshot{Content: string(content)}, nil
+}
+
+// restoreFile puts path back into the state captured by snapshotFile.
+func restoreFile(path string, snap *FileSnapshot) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	switch {
+	case snap.Missing:
+		return nil
+	case snap.Link != "":
+		return os.Symlink(snap.Link, path)
+	default:
+		return os.WriteFile(path, []byte(snap.Content), 0644)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resolv.conf")
+
+	tests := []struct {
+		name  string
+		setup func() error
+		check func() bool
+	}{
+		{
+			name:  "regular file",
+			setup: func() error { return os.WriteFile(path, []byte("nameserver 10.0.0.2\n"), 0644) },
+			check: func() bool {
+				content, err := os.ReadFile(path)
+				return err == nil && string(content) == "nameserver 10.0.0.2\n"
+			},
+		},
+		{
+			name:  "symlink",
+			setup: func() error { return os.Symlink("../run/stub-resolv.conf", path) },
+			check: func() bool {
+				target, err := os.Readlink(path)
+				return err == nil && target == "../run/stub-resolv.conf"
+			},
+		},
+		{
+			name:  "missing",
+			setup: func() error { return nil },
+			check: func() bool {
+				_, err := os.Lstat(path)
+				return os.IsNotExist(err)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		os.Remove(path)
+		if err := test.setup(); err != nil {
+			t.Fatal(err)
+		}
+		snap, err := snapshotFile(path)
+		if err != nil {
+			t.Fatalf("%s: snapshotFile() error = %v", test.name, err)
+		}
+
+		os.Remove(path)
+		if err := os.WriteFile(path, []byte("nameserver 127.0.0.1\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := restoreFile(path, snap); err != nil {
+			t.Fatalf("%s: restoreFile() error = %v", test.name, err)
+		}
+		if !test.check() {
+			t.Errorf("%s: file not restored", test.name)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// Connections into the cluster are port-forward streams, one data and one
+// error stream per connection as kubectl port-forward opens them for every
+// accepted socket. They share one upgraded connection per pod and are handed
+// to the tunnel as a net.Conn, without a local listener in between.
+
+// streamErrorWait bounds the wait for the error stream once the data stream
+// ended, to report why the pod side closed it.
+const streamErrorWait = time.Second
+
+// portForwardURL is the portforward subresource of pod.
+func portForwardURL(cfg *rest.Config, pod *v1.Pod) (*url.URL, error) {
+	targetURL, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target URL: %w", err)
+	}
+
+	if pod == nil {
+		return nil, fmt.Errorf("pod is nil")
+	}
+
+	if pod.Name == "" || pod.Namespace == "" {
+		return nil, fmt.Errorf("pod name or namespace is empty")
+	}
+
+	targetURL.Path = path.Join(
+		"/api/v1/namespaces", pod.Namespace, "pods", pod.Name, "portforward",
+	)
+	return targetURL, nil
+}
+
+// dialPod opens the port-forward connection to pod. It tunnels SPDY over
+// WebSockets, and falls back to a plain SPDY upgrade for apiservers without
+// WebSocket port-forward support.
+func dialPod(cfg *rest.Config, pod *v1.Pod) (httpstream.Connection, error) {
+	targetURL, err := portForwardURL(cfg, pod)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create round tripper: %w", err)
+	}
+	var dialer httpstream.Dialer = spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, targetURL)
+
+	if ws, err := portforward.NewSPDYOverWebsocketDialer(targetURL, cfg); err == nil {
+		dialer = portforward.NewFallbackDialer(ws, dialer, func(err error) bool {
+			return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+		})
+	}
+
+	conn, protocol, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, fmt.Errorf("error upgrading connection: %w", err)
+	}
+	if protocol != portforward.PortForwardProtocolV1Name {
+		conn.Close()
+		return nil, fmt.Errorf("unable to negotiate protocol: client supports %q, server returned %q", portforward.PortForwardProtocolV1Name, protocol)
+	}
+	return conn, nil
+}
+
+// streamAddr is the local address of a stream connection.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "portforward" }
+func (a streamAddr) String() string  { return string(a) }
+
+// streamConn is a connection to a port of a pod over a port-forward stream
+// pair.
+type streamConn struct {
+	conn   httpstream.Connection
+	data   httpstream.Stream
+	errs   httpstream.Stream
+	errc   chan error
+	remote net.Addr
+
+	mu       sync.Mutex
+	deadline *time.Timer
+	once     sync.Once
+}
+
+// openStream opens a connection to port on pod over conn. requestID pairs
+// the data and error streams and must be unique on conn.
+func openStream(conn httpstream.Connection, pod *v1.Pod, port int32, requestID int64) (*streamConn, error) {
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, strconv.Itoa(int(port)))
+	headers.Set(v1.PortForwardRequestIDHeader, strconv.FormatInt(requestID, 10))
+	errs, err := conn.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("error creating error stream for %s/%s:%d: %w", pod.Namespace, pod.Name, port, err)
+	}
+	// we're not writing to this stream
+	errs.Close()
+
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	data, err := conn.CreateStream(headers)
+	if err != nil {
+		errs.Reset()
+		conn.RemoveStreams(errs)
+		return nil, fmt.Errorf("error creating forwarding stream for %s/%s:%d: %w", pod.Namespace, pod.Name, port, err)
+	}
+
+	c := &streamConn{
+		conn:   conn,
+		data:   data,
+		errs:   errs,
+		errc:   make(chan error, 1),
+		remote: &net.TCPAddr{IP: net.ParseIP(pod.Status.PodIP), Port: int(port)},
+	}
+	go func() {
+		message, err := io.ReadAll(errs)
+		switch {
+		case err != nil:
+			c.errc <- fmt.Errorf("error reading from error stream for %s/%s:%d: %w", pod.Namespace, pod.Name, port, err)
+		case len(message) > 0:
+			c.errc <- fmt.Errorf("an error occurred forwarding to %s/%s:%d: %s", pod.Namespace, pod.Name, port, message)
+		}
+		close(c.errc)
+	}()
+	return c, nil
+}
+
+// Read returns the error the pod side reported, if any, in place of EOF.
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.data.Read(b)
+	if err == io.EOF {
+		select {
+		case perr, ok := <-c.errc:
+			if ok && perr != nil {
+				return n, perr
+			}
+		case <-time.After(streamErrorWait):
+		}
+	}
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	return c.data.Write(b)
+}
+
+// CloseWrite tells the pod side no more data follows.
+func (c *streamConn) CloseWrite() error {
+	return c.data.Close()
+}
+
+func (c *streamConn) Close() error {
+	c.once.Do(func() {
+		c.SetDeadline(time.Time{})
+		c.data.Reset()
+		c.errs.Reset()
+		c.conn.RemoveStreams(c.data, c.errs)
+	})
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return streamAddr("portforward") }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline resets the stream once t passes. Streams have no deadlines of
+// their own, and the tunnel only sets them to end a connection whose other
+// direction is done, so blocked calls failing for good is enough.
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.deadline != nil {
+		c.deadline.Stop()
+		c.deadline = nil
+	}
+	if !t.IsZero() {
+		c.deadline = time.AfterFunc(time.Until(t), func() { c.data.Reset() })
+	}
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return c.SetDeadline(t) }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return c.SetDeadline(t) }
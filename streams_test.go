@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+var errStreamReset = errors.New("stream reset")
+
+// fakeStream is one end of an in-memory stream. Close only ends the writing
+// direction, like a SPDY half-close.
+type fakeStream struct {
+	r       *io.PipeReader
+	w       *io.PipeWriter
+	headers http.Header
+}
+
+func newFakeStreamPair(headers http.Header) (client, server *fakeStream) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	return &fakeStream{r: cr, w: cw, headers: headers}, &fakeStream{r: sr, w: sw, headers: headers}
+}
+
+func (s *fakeStream) Read(b []byte) (int, error)  { return s.r.Read(b) }
+func (s *fakeStream) Write(b []byte) (int, error) { return s.w.Write(b) }
+func (s *fakeStream) Close() error                { return s.w.Close() }
+func (s *fakeStream) Headers() http.Header        { return s.headers }
+func (s *fakeStream) Identifier() uint32          { return 0 }
+
+func (s *fakeStream) Reset() error {
+	s.r.CloseWithError(errStreamReset)
+	s.w.CloseWithError(errStreamReset)
+	return nil
+}
+
+// fakeConnection is an in-memory port-forward connection. The pod side of
+// every stream created on it is sent on streams.
+type fakeConnection struct {
+	streams chan *fakeStream
+	closed  chan bool
+	once    sync.Once
+
+	mu      sync.Mutex
+	removed int
+}
+
+func newFakeConnection() *fakeConnection {
+	return &fakeConnection{streams: make(chan *fakeStream, 16), closed: make(chan bool)}
+}
+
+func (c *fakeConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	client, server := newFakeStreamPair(headers.Clone())
+	c.streams <- server
+	return client, nil
+}
+
+func (c *fakeConnection) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakeConnection) CloseChan() <-chan bool       { return c.closed }
+func (c *fakeConnection) SetIdleTimeout(time.Duration) {}
+
+func (c *fakeConnection) RemoveStreams(streams ...httpstream.Stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removed += len(streams)
+}
+
+var testStreamPod = &v1.Pod{
+	ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+	Status:     v1.PodStatus{PodIP: "10.244.0.5"},
+}
+
+func TestStreamConn(t *testing.T) {
+	conn := newFakeConnection()
+	c, err := openStream(conn, testStreamPod, 8080, 7)
+	if err != nil {
+		t.Fatalf("openStream() error = %v", err)
+	}
+	errs, data := <-conn.streams, <-conn.streams
+
+	for _, test := range []struct {
+		s          *fakeStream
+		streamType string
+	}{{errs, v1.StreamTypeError}, {data, v1.StreamTypeData}} {
+		h := test.s.Headers()
+		if h.Get(v1.StreamType) != test.streamType || h.Get(v1.PortHeader) != "8080" || h.Get(v1.PortForwardRequestIDHeader) != "7" {
+			t.Errorf("%s stream headers = %v", test.streamType, h)
+		}
+	}
+	if got := c.RemoteAddr().String(); got != "10.244.0.5:8080" {
+		t.Errorf("RemoteAddr() = %s; want 10.244.0.5:8080", got)
+	}
+
+	go func() {
+		c.Write([]byte("ping"))
+		c.CloseWrite()
+	}()
+	if got, err := io.ReadAll(data); err != nil || string(got) != "ping" {
+		t.Errorf("pod side read %q, %v; want ping", got, err)
+	}
+
+	go func() {
+		data.Write([]byte("pong"))
+		data.Close()
+		errs.Close()
+	}()
+	if got, err := io.ReadAll(c); err != nil || string(got) != "pong" {
+		t.Errorf("ReadAll() = %q, %v; want pong", got, err)
+	}
+
+	c.Close()
+	c.Close()
+	if conn.removed != 2 {
+		t.Errorf("Close() removed %d streams; want 2", conn.removed)
+	}
+}
+
+func TestStreamConnPodError(t *testing.T) {
+	conn := newFakeConnection()
+	c, err := openStream(conn, testStreamPod, 8080, 1)
+	if err != nil {
+		t.Fatalf("openStream() error = %v", err)
+	}
+	defer c.Close()
+	errs, data := <-conn.streams, <-conn.streams
+
+	go func() {
+		errs.Write([]byte("dial tcp4 127.0.0.1:8080: connect: connection refused"))
+		errs.Close()
+		data.Close()
+	}()
+	_, err = io.ReadAll(c)
+	if err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("ReadAll() error = %v; want the pod side error", err)
+	}
+}
+
+func TestStreamConnDeadline(t *testing.T) {
+	conn := newFakeConnection()
+	c, err := openStream(conn, testStreamPod, 8080, 1)
+	if err != nil {
+		t.Fatalf("openStream() error = %v", err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Read() past the deadline error = nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Read() blocked past the deadline")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// excludePrefix returns the smallest set of prefixes that covers p without
+// ex. p is halved until the half holding ex is ex itself, keeping the other
+// half at every step.
+func excludePrefix(p, ex netip.Prefix) []netip.Prefix {
+	p, ex = p.Masked(), ex.Masked()
+	if !p.Overlaps(ex) {
+		return []netip.Prefix{p}
+	}
+	if ex.Bits() <= p.Bits() {
+		return nil
+	}
+
+	var out []netip.Prefix
+	for cur := p; cur.Bits() < ex.Bits(); {
+		lo, hi := splitPrefix(cur)
+		if lo.Contains(ex.Addr()) {
+			out = append(out, hi)
+			cur = lo
+		} else {
+			out = append(out, lo)
+			cur = hi
+		}
+	}
+	sortPrefixes(out)
+	return out
+}
+
+// excludePrefixes removes every range in excludes from prefixes.
+func excludePrefixes(prefixes, excludes []netip.Prefix) []netip.Prefix {
+	out := slices.Clone(prefixes)
+	for _, ex := range excludes {
+		var next []netip.Prefix
+		for _, p := range out {
+			next = append(next, excludePrefix(p, ex)...)
+		}
+		out = next
+	}
+	return mergePrefixes(out)
+}
+
+// splitPrefix halves p into two prefixes one bit longer.
+func splitPrefix(p netip.Prefix) (lo, hi netip.Prefix) {
+	bits := p.Bits()
+	lo = netip.PrefixFrom(p.Addr(), bits+1)
+
+	b := p.Addr().AsSlice()
+	b[bits/8] |= 0x80 >> (bits % 8)
+	addr, _ := netip.AddrFromSlice(b)
+	hi = netip.PrefixFrom(addr, bits+1)
+	return lo, hi
+}
+
+// sortPrefixes orders prefixes by address, wider ranges first.
+func sortPrefixes(prefixes []netip.Prefix) {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+}
+
+// ipNetPrefix converts ipnet to a masked prefix, unmapping IPv4 addresses
+// stored in 16 bytes.
+func ipNetPrefix(ipnet *net.IPNet) (netip.Prefix, bool) {
+	ip, ok := netip.AddrFromSlice(ipnet.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits == 0 {
+		return netip.Prefix{}, false
+	}
+	if ip.Is4In6() {
+		ip = ip.Unmap()
+		if bits == 8*net.IPv6len {
+			ones -= 96
+		}
+	}
+	return netip.PrefixFrom(ip, ones).Masked(), true
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestExcludePrefix(t *testing.T) {
+	tests := []struct {
+		p, ex    string
+		expected []netip.Prefix
+	}{
+		{"10.0.0.0/8", "192.168.0.0/16", prefixes("10.0.0.0/8")},
+		{"10.0.0.0/8", "10.0.0.0/8", nil},
+		{"10.1.0.0/16", "10.0.0.0/8", nil},
+		{"10.0.0.0/8", "10.0.0.0/9", prefixes("10.128.0.0/9")},
+		{"10.0.0.0/8", "10.255.0.0/16", prefixes(
+			"10.0.0.0/9", "10.128.0.0/10", "10.192.0.0/11", "10.224.0.0/12",
+			"10.240.0.0/13", "10.248.0.0/14", "10.252.0.0/15", "10.254.0.0/16",
+		)},
+		{"192.168.0.0/22", "192.168.1.0/24", prefixes("192.168.0.0/24", "192.168.2.0/23")},
+		{"192.168.0.0/30", "192.168.0.2/32", prefixes("192.168.0.0/31", "192.168.0.3/32")},
+		{"10.96.0.0/12", "10.100.7.9/24", prefixes(
+			"10.96.0.0/14", "10.100.0.0/22", "10.100.4.0/23", "10.100.6.0/24",
+			"10.100.8.0/21", "10.100.16.0/20", "10.100.32.0/19", "10.100.64.0/18",
+			"10.100.128.0/17", "10.101.0.0/16", "10.102.0.0/15", "10.104.0.0/13",
+		)},
+		{"fd00::/8", "fd00::/9", prefixes("fd80::/9")},
+		{"0.0.0.0/0", "128.0.0.0/1", prefixes("0.0.0.0/1")},
+	}
+
+	for _, test := range tests {
+		p, ex := netip.MustParsePrefix(test.p), netip.MustParsePrefix(test.ex)
+		if got := excludePrefix(p, ex); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("excludePrefix(%s, %s) = %v; want %v", p, ex, got, test.expected)
+		}
+	}
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	tests := []struct {
+		input, excludes []netip.Prefix
+		expected        []netip.Prefix
+	}{
+		{prefixes("10.0.0.0/8"), nil, prefixes("10.0.0.0/8")},
+		{prefixes("10.0.0.0/8", "172.16.0.0/12"), prefixes("10.0.0.0/8"), prefixes("172.16.0.0/12")},
+		{prefixes("10.0.0.0/8"), prefixes("10.0.0.0/10", "10.64.0.0/10"), prefixes("10.128.0.0/9")},
+		{prefixes("10.0.0.0/8"), prefixes("10.128.0.0/9", "10.0.0.0/9"), nil},
+		{prefixes("192.168.0.0/23", "192.168.4.0/24"), prefixes("192.168.1.0/24", "192.168.4.0/25"), prefixes("192.168.0.0/24", "192.168.4.128/25")},
+	}
+
+	for _, test := range tests {
+		if got := excludePrefixes(test.input, test.excludes); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("excludePrefixes(%v, %v) = %v; want %v", test.input, test.excludes, got, test.expected)
+		}
+	}
+}
+
+func TestSubnetPrefixesExcludes(t *testing.T) {
+	opt := &Opts{
+		Subnets:        []string{"10.0.0.0/8", "", "172.16.0.0/12"},
+		ExcludeSubnets: []string{"10.0.0.0/9"},
+	}
+	got, err := subnetPrefixes(opt)
+	if err != nil {
+		t.Fatalf("subnetPrefixes() error = %v", err)
+	}
+	if want := prefixes("10.128.0.0/9", "172.16.0.0/12"); !reflect.DeepEqual(got, want) {
+		t.Errorf("subnetPrefixes() = %v; want %v", got, want)
+	}
+
+	opt.ExcludeSubnets = []string{"10.0.0.0"}
+	if _, err := subnetPrefixes(opt); err == nil {
+		t.Errorf("subnetPrefixes() with invalid exclude: expected error")
+	}
+}
+
+func TestIPNetPrefix(t *testing.T) {
+	tests := []struct {
+		ipnet    *net.IPNet
+		expected string
+	}{
+		{&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(16, 32)}, "10.1.0.0/16"},
+		{&net.IPNet{IP: net.ParseIP("10.1.2.3"), Mask: net.CIDRMask(120, 128)}, "10.1.2.0/24"},
+		{&net.IPNet{IP: net.ParseIP("10.1.2.3").To4(), Mask: net.CIDRMask(8, 32)}, "10.0.0.0/8"},
+		{&net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)}, "fd00::/64"},
+	}
+
+	for _, test := range tests {
+		got, ok := ipNetPrefix(test.ipnet)
+		if !ok || got.String() != test.expected {
+			t.Errorf("ipNetPrefix(%v) = %v, %v; want %s", test.ipnet, got, ok, test.expected)
+		}
+	}
+}
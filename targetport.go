@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// podTargetPort translates port on the destination ip to the port to forward
+// to on pod. When ip is a cluster IP of a service in the pod's namespace, the
+// matching ServicePort's targetPort is used, resolving named ports against
+// the pod's containers. Pod IPs keep their port.
+func (c *clusterCache) podTargetPort(pod *v1.Pod, ip string, port int32, protocol v1.Protocol) (int32, error) {
+	if svc := c.serviceByIP(ip); svc != nil && svc.Namespace == pod.Namespace {
+		return serviceTargetPort(svc, pod, port, protocol)
+	}
+	return port, nil
+}
+
+// serviceTargetPort resolves the targetPort of the svc port matching port
+// and protocol on pod.
+func serviceTargetPort(svc *v1.Service, pod *v1.Pod, port int32, protocol v1.Protocol) (int32, error) {
+	for _, sp := range svc.Spec.Ports {
+		if sp.Port != port || protocolOrTCP(sp.Protocol) != protocol {
+			continue
+		}
+		switch {
+		case sp.TargetPort.Type == intstr.String && sp.TargetPort.StrVal != "":
+			return namedContainerPort(pod, sp.TargetPort.StrVal, protocol)
+		case sp.TargetPort.IntVal != 0:
+			return sp.TargetPort.IntVal, nil
+		default:
+			// an unset targetPort defaults to port
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("service %s/%s has no %s port %d", svc.Namespace, svc.Name, protocol, port)
+}
+
+// namedContainerPort looks up the container port called name on pod, in its
+// containers and its sidecars, the init containers that keep running.
+func namedContainerPort(pod *v1.Pod, name string, protocol v1.Protocol) (int32, error) {
+	containers := append([]v1.Container(nil), pod.Spec.Containers...)
+	for _, container := range pod.Spec.InitContainers {
+		if container.RestartPolicy != nil && *container.RestartPolicy == v1.ContainerRestartPolicyAlways {
+			containers = append(containers, container)
+		}
+	}
+	for _, container := range containers {
+		for _, cp := range container.Ports {
+			if cp.Name == name && protocolOrTCP(cp.Protocol) == protocol {
+				return cp.ContainerPort, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("pod %s/%s has no %s port named %q", pod.Namespace, pod.Name, protocol, name)
+}
+
+func protocolOrTCP(p v1.Protocol) v1.Protocol {
+	if p == "" {
+		return v1.ProtocolTCP
+	}
+	return p
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestPodTargetPort(t *testing.T) {
+	always := v1.ContainerRestartPolicyAlways
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+		Spec: v1.PodSpec{
+			InitContainers: []v1.Container{
+				{Name: "proxy", RestartPolicy: &always, Ports: []v1.ContainerPort{{Name: "proxy", ContainerPort: 15001}}},
+				{Name: "migrate", Ports: []v1.ContainerPort{{Name: "migrate", ContainerPort: 7000}}},
+			},
+			Containers: []v1.Container{
+				{Name: "app", Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080}, {Name: "dns", ContainerPort: 5353, Protocol: v1.ProtocolUDP}}},
+				{Name: "metrics", Ports: []v1.ContainerPort{{Name: "metrics", ContainerPort: 9090, Protocol: v1.ProtocolTCP}}},
+			},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			ClusterIP:  "10.96.0.20",
+			ClusterIPs: []string{"10.96.0.20", "fd00:10:96::20"},
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt32(8080)},
+				{Name: "plain", Port: 8000},
+				{Name: "named", Port: 443, TargetPort: intstr.FromString("http"), Protocol: v1.ProtocolTCP},
+				{Name: "metrics", Port: 9000, TargetPort: intstr.FromString("metrics")},
+				{Name: "dns", Port: 53, TargetPort: intstr.FromString("dns")},
+				{Name: "missing", Port: 8443, TargetPort: intstr.FromString("https")},
+				{Name: "sidecar", Port: 15001, TargetPort: intstr.FromString("proxy")},
+				{Name: "init", Port: 7000, TargetPort: intstr.FromString("migrate")},
+			},
+		},
+	}
+	c := newTestCache(t, pod, svc)
+
+	tests := []struct {
+		ip      string
+		port    int32
+		want    int32
+		wantErr bool
+	}{
+		{"10.244.0.5", 80, 80, false},
+		{"10.96.0.20", 80, 8080, false},
+		{"10.96.0.20", 8000, 8000, false},
+		{"10.96.0.20", 443, 8080, false},
+		{"10.96.0.20", 9000, 9090, false},
+		{"fd00:10:96::20", 80, 8080, false},
+		{"10.96.0.20", 22, 0, true},
+		{"10.96.0.20", 53, 0, true},
+		{"10.96.0.20", 8443, 0, true},
+		{"10.96.0.20", 15001, 15001, false},
+		{"10.96.0.20", 7000, 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := c.podTargetPort(pod, test.ip, test.port, v1.ProtocolTCP)
+		if (err != nil) != test.wantErr {
+			t.Errorf("podTargetPort(%s, %d) error = %v; wantErr %v", test.ip, test.port, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("podTargetPort(%s, %d) = %d; want %d", test.ip, test.port, got, test.want)
+		}
+	}
+}
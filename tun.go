@@ -6,9 +6,6 @@ import (
 	"net"
 	"net/netip"
 	"net/url"
-	"os"
-	"os/exec"
-	"regexp"
 	"strings"
 
 	"go.uber.org/zap"
@@ -62,60 +59,30 @@ func configure(opt *Opts) error {
 	return nil
 }
 
-var postUp = `
-ifconfig %s 198.18.0.1 198.18.0.1 up
-localdns="127.0.0.1"
-iface=$(route get default | grep interface | awk '{print $2}')
-echo "Interface: $iface"
-hwport=$(networksetup -listallhardwareports | grep -B 1 "$iface" | awk -F': ' '/Hardware Port/{ print $2 }')
-echo "Hardware Port: $hwport"
-
-networksetup -setdnsservers "$hwport" "$localdns"
-`
-
-var preDown = `
-localdns="127.0.0.1"
-iface=$(route get default | grep interface | awk '{print $2}')
-echo "Interface: $iface"
-hwport=$(networksetup -listallhardwareports | grep -B 1 "$iface" | awk -F': ' '/Hardware Port/{ print $2 }')
-echo "Hardware Port: $hwport"
-networksetup -setdnsservers "$hwport" empty
-`
-
 func bootNetstack(opt *Opts) (err error) {
 	log.Infof("[NETSTACK] starting...")
 	if opt.Device == "" {
 		return errors.New("empty device")
 	}
 
-	reg := regexp.MustCompile(`^utun[0-9]+$`)
-	if !reg.MatchString(opt.Device) {
+	if !validDevice(deviceName(opt.Device)) {
 		return errors.New("invalid device")
 	}
 
-	log.Infof("[TUN] pre-executing scripts")
-	if preUpErr := execCommand("echo hi"); preUpErr != nil {
-		log.Errorf("[TUN] failed to pre-execute: %v", preUpErr)
-		return preUpErr
-	}
-
 	defer func() {
-		log.Infof("[TUN] post-executing scripts")
-		for _, subnet := range opt.Subnets {
-			if subnet == "" {
-				continue
-			}
-			postUp += fmt.Sprintf("\nroute add -net %s -interface %s", subnet, opt.Device)
+		if err != nil {
+			return
 		}
-		if postUpErr := execCommand(fmt.Sprintf(postUp, opt.Device)); postUpErr != nil {
-			log.Fatalf("[TUN] failed to post-execute: %v", postUpErr)
+		log.Infof("[TUN] configuring host network")
+		if postUpErr := _setup.Up(opt); postUpErr != nil {
+			log.Fatalf("[TUN] failed to configure host network: %v", postUpErr)
 		}
 	}()
 
 	_defaultProxy = NewDirect() // Use the Direct proxy
 	tunnel.T().SetDialer(_defaultProxy)
 
-	if _defaultDevice, err = parseDevice(opt.Device, uint32(0)); err != nil {
+	if _defaultDevice, err = openDevice(opt.Device, uint32(0)); err != nil {
 		return
 	}
 
@@ -162,9 +129,9 @@ func StartTun() {
 // StopTun stops the TUN/TAP engine.
 func StopTun() {
 
-	log.Infof("[TUN] pre-stopping scripts")
-	if preDownErr := execCommand(preDown); preDownErr != nil {
-		log.Fatalf("[TUN] failed to pre-stop: %v", preDownErr)
+	log.Infof("[TUN] restoring host network")
+	if preDownErr := _setup.Down(_defaultOpt); preDownErr != nil {
+		log.Fatalf("[TUN] failed to restore host network: %v", preDownErr)
 	}
 
 	_engineMu.Lock()
@@ -186,27 +153,17 @@ func InsertOptsTun(opt *Opts) {
 	_engineMu.Unlock()
 }
 
-func execCommand(cmd string) error {
-	// write to a tmp shell script
-	tmp := os.TempDir()
-	file := fmt.Sprintf("%s/%s", tmp, "kubectl-link-postup.sh")
-	if err := os.WriteFile(file, []byte(cmd), 0755); err != nil {
-		return err
-	}
-
-	// execute the shell script
-	if err := exec.Command("sh", file).Run(); err != nil {
-		return err
+// deviceName strips the optional driver scheme from the device string.
+func deviceName(s string) string {
+	if _, name, ok := strings.Cut(s, "://"); ok {
+		return name
 	}
-
-	// remove the tmp shell script
-	if err := os.Remove(file); err != nil {
-		return err
-	}
-
-	return nil
+	return s
 }
 
+// openDevice opens the tun device, it is replaced in tests.
+var openDevice = parseDevice
+
 // parseDevice parses the device string and returns a device.Device.
 func parseDevice(s string, mtu uint32) (device.Device, error) {
 	if !strings.Contains(s, "://") {
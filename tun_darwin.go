@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/route"
+	"golang.org/x/sys/unix"
+)
+
+const defaultDeviceName = "utun123"
+
+const dnsListenAddr = ":53"
+
+// tunOffset is the size of the address family header utun puts in front of
+// every packet.
+const tunOffset = 4
+
+const utunControl = "com.apple.net.utun_control"
+
+var utunPattern = regexp.MustCompile(`^utun[0-9]+$`)
+
+// validDevice reports whether name can be opened as a tun device on macOS,
+// where the kernel only hands out utunN devices.
+func validDevice(name string) bool {
+	return utunPattern.MatchString(name)
+}
+
+// defaultInterface returns the interface holding the primary IPv4 default
+// route, read from the routing table instead of `route get default`.
+func defaultInterface() (string, error) {
+	rib, err := route.FetchRIB(syscall.AF_INET, route.RIBTypeRoute, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch routing table: %w", err)
+	}
+	msgs, err := route.ParseRIB(route.RIBTypeRoute, rib)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse routing table: %w", err)
+	}
+
+	for _, msg := range msgs {
+		rm, ok := msg.(*route.RouteMessage)
+		if !ok || rm.Flags&syscall.RTF_UP == 0 || rm.Flags&syscall.RTF_GATEWAY == 0 {
+			continue
+		}
+		// scoped default routes belong to secondary interfaces
+		if rm.Flags&syscall.RTF_IFSCOPE != 0 {
+			continue
+		}
+		if len(rm.Addrs) <= syscall.RTAX_NETMASK || !isZeroAddr(rm.Addrs[syscall.RTAX_DST]) || !isZeroAddr(rm.Addrs[syscall.RTAX_NETMASK]) {
+			continue
+		}
+		iface, err := net.InterfaceByIndex(rm.Index)
+		if err != nil {
+			continue
+		}
+		return iface.Name, nil
+	}
+
+	return "", errors.New("no default route found")
+}
+
+func isZeroAddr(a route.Addr) bool {
+	switch a := a.(type) {
+	case nil:
+		return true
+	case *route.Inet4Addr:
+		return a.IP == [4]byte{}
+	default:
+		return false
+	}
+}
+
+// localRoutes returns the routes of the routing table, leaving out the
+// neighbour, broadcast and multicast entries the kernel clones.
+func localRoutes() ([]localRoute, error) {
+	rib, err := route.FetchRIB(syscall.AF_UNSPEC, route.RIBTypeRoute, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch routing table: %w", err)
+	}
+	msgs, err := route.ParseRIB(route.RIBTypeRoute, rib)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routing table: %w", err)
+	}
+
+	const skip = syscall.RTF_LLINFO | syscall.RTF_WASCLONED | syscall.RTF_BROADCAST | syscall.RTF_MULTICAST
+	names := map[int]string{}
+	var out []localRoute
+	for _, msg := range msgs {
+		rm, ok := msg.(*route.RouteMessage)
+		if !ok || rm.Flags&syscall.RTF_UP == 0 || rm.Flags&skip != 0 || len(rm.Addrs) <= syscall.RTAX_DST {
+			continue
+		}
+		dst, ok := routeAddr(rm.Addrs[syscall.RTAX_DST])
+		if !ok {
+			continue
+		}
+		bits := dst.BitLen()
+		if rm.Flags&syscall.RTF_HOST == 0 {
+			bits = 0
+			if len(rm.Addrs) > syscall.RTAX_NETMASK {
+				if mask, ok := routeAddr(rm.Addrs[syscall.RTAX_NETMASK]); ok {
+					bits, _ = net.IPMask(mask.AsSlice()).Size()
+				}
+			}
+		}
+
+		lr := localRoute{Dst: netip.PrefixFrom(dst, bits).Masked()}
+		if rm.Flags&syscall.RTF_GATEWAY != 0 && len(rm.Addrs) > syscall.RTAX_GATEWAY {
+			lr.Gateway, _ = routeAddr(rm.Addrs[syscall.RTAX_GATEWAY])
+		}
+
+		name, ok := names[rm.Index]
+		if !ok {
+			if iface, err := net.InterfaceByIndex(rm.Index); err == nil {
+				name = iface.Name
+			}
+			names[rm.Index] = name
+		}
+		lr.Interface = name
+		out = append(out, lr)
+	}
+	return out, nil
+}
+
+func routeAddr(a route.Addr) (netip.Addr, bool) {
+	switch a := a.(type) {
+	case *route.Inet4Addr:
+		return netip.AddrFrom4(a.IP), true
+	case *route.Inet6Addr:
+		return netip.AddrFrom16(a.IP), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// openTunFD creates the utun device name and returns its fd, for the
+// privileged helper to pass to the main process.
+func openTunFD(name string) (int, error) {
+	if !validDevice(name) {
+		return -1, fmt.Errorf("invalid utun device %q", name)
+	}
+	unit, err := strconv.Atoi(strings.TrimPrefix(name, "utun"))
+	if err != nil {
+		return -1, err
+	}
+
+	fd, err := unix.Socket(unix.AF_SYSTEM, unix.SOCK_DGRAM, unix.AF_SYS_CONTROL)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open control socket: %w", err)
+	}
+	unix.CloseOnExec(fd)
+
+	info := &unix.CtlInfo{}
+	copy(info.Name[:], utunControl)
+	if err := unix.IoctlCtlInfo(fd, info); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to look up %s: %w", utunControl, err)
+	}
+	// unit 0 lets the kernel pick, so utunN is unit N+1
+	if err := unix.Connect(fd, &unix.SockaddrCtl{ID: info.Id, Unit: uint32(unit) + 1}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const defaultDeviceName = "kubelink0"
+
+// dnsListenAddr avoids the wildcard address so the proxy can coexist with
+// systemd-resolved's stub listener on 127.0.0.53.
+const dnsListenAddr = "127.0.0.1:53"
+
+// tunOffset is the size of the packet header on tun fds, IFF_NO_PI leaves
+// none.
+const tunOffset = 0
+
+// validDevice reports whether name is usable as a Linux interface name.
+func validDevice(name string) bool {
+	return name != "" && len(name) < unix.IFNAMSIZ && !strings.ContainsAny(name, "/: \t\n")
+}
+
+// defaultInterface returns the interface holding the IPv4 default route.
+func defaultInterface() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", fmt.Errorf("failed to list routes: %w", err)
+	}
+
+	for _, r := range routes {
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		link, err := netlink.LinkByIndex(r.LinkIndex)
+		if err != nil {
+			continue
+		}
+		return link.Attrs().Name, nil
+	}
+
+	return "", errors.New("no default route found")
+}
+
+// localRoutes returns the routes of the main routing table.
+func localRoutes() ([]localRoute, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %w", err)
+	}
+
+	names := map[int]string{}
+	var out []localRoute
+	for _, r := range routes {
+		gw, index := r.Gw, r.LinkIndex
+		if gw == nil && len(r.MultiPath) > 0 {
+			gw, index = r.MultiPath[0].Gw, r.MultiPath[0].LinkIndex
+		}
+
+		lr := localRoute{Dst: netip.PrefixFrom(netip.IPv4Unspecified(), 0)}
+		if r.Family == netlink.FAMILY_V6 {
+			lr.Dst = netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+		}
+		if r.Dst != nil {
+			p, ok := ipNetPrefix(r.Dst)
+			if !ok {
+				continue
+			}
+			lr.Dst = p
+		}
+		if ip, ok := netip.AddrFromSlice(gw); ok {
+			lr.Gateway = ip.Unmap()
+		}
+
+		name, ok := names[index]
+		if !ok {
+			if link, err := netlink.LinkByIndex(index); err == nil {
+				name = link.Attrs().Name
+			}
+			names[index] = name
+		}
+		lr.Interface = name
+		out = append(out, lr)
+	}
+	return out, nil
+}
+
+// openTunFD creates the tun device name and returns its fd, for the
+// privileged helper to pass to the main process.
+func openTunFD(name string) (int, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open /dev/net/tun: %w", err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	ifr.SetUint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+)
+
+// UDP is carried to the cluster through a relay pod, since port-forward only
+// speaks TCP. Every UDP session is one port-forwarded stream to the relay,
+// which sends the datagrams from inside the cluster. Both directions use the
+// same frame:
+//
+//	[1 byte address length][address "ip:port"][2 byte payload length][payload]
+//
+// The address is the destination towards the relay and the source of the
+// reply on the way back.
+
+const (
+	udpRelayPort         = 5301
+	udpRelayLabel        = "app.kubernetes.io/name"
+	udpRelayName         = "kubectl-link-udp-relay"
+	udpRelayStartTimeout = 2 * time.Minute
+	// udpRelayHostLabel names the host that started a relay, so a later run
+	// there can delete relays a crashed run left behind.
+	udpRelayHostLabel = "kubectl-link/host"
+)
+
+// udpRelayReadyProbe connects to the relay from inside its container. The
+// relay only listens on loopback, which a tcpSocket probe from the kubelet
+// can not reach.
+var udpRelayReadyProbe = []string{"python3", "-c", fmt.Sprintf("import socket; socket.create_connection(('127.0.0.1', %d), 1).close()", udpRelayPort)}
+
+// udpRelayScript is run by the relay container with python3 -c. It listens on
+// udpRelayPort.
+const udpRelayScript = `
+import socket, struct, threading
+
+def recvn(c, n):
+    b = b''
+    while len(b) < n:
+        d = c.recv(n - len(b))
+        if not d:
+            raise EOFError
+        b += d
+    return b
+
+def replies(c, s, lock):
+    try:
+        while True:
+            p, a = s.recvfrom(65535)
+            h = ('[%s]:%d' if ':' in a[0] else '%s:%d') % (a[0], a[1])
+            h = h.encode()
+            with lock:
+                c.sendall(bytes([len(h)]) + h + struct.pack('!H', len(p)) + p)
+    except Exception:
+        pass
+
+def serve(c):
+    socks, lock = {}, threading.Lock()
+    try:
+        while True:
+            host, port = recvn(c, recvn(c, 1)[0]).decode().rsplit(':', 1)
+            host = host.strip('[]')
+            p = recvn(c, struct.unpack('!H', recvn(c, 2))[0])
+            f = socket.AF_INET6 if ':' in host else socket.AF_INET
+            with lock:
+                if f not in socks:
+                    socks[f] = socket.socket(f, socket.SOCK_DGRAM)
+                    threading.Thread(target=replies, args=(c, socks[f], lock), daemon=True).start()
+            socks[f].sendto(p, (host, int(port)))
+    except Exception:
+        pass
+    finally:
+        for s in socks.values():
+            s.close()
+        c.close()
+
+l = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+l.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+l.bind(('127.0.0.1', 5301))
+l.listen(128)
+while True:
+    c, _ = l.accept()
+    threading.Thread(target=serve, args=(c,), daemon=True).start()
+`
+
+// writeUDPFrame writes one datagram for addr in a single Write.
+func writeUDPFrame(w io.Writer, addr string, payload []byte) error {
+	if len(addr) > 0xff {
+		return fmt.Errorf("udp relay: address %q too long", addr)
+	}
+	if len(payload) > 0xffff {
+		return fmt.Errorf("udp relay: datagram of %d bytes too large", len(payload))
+	}
+	frame := make([]byte, 0, 1+len(addr)+2+len(payload))
+	frame = append(frame, byte(len(addr)))
+	frame = append(frame, addr...)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	frame = append(frame, payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readUDPFrame reads one datagram and the address it carries.
+func readUDPFrame(r io.Reader) (addr string, payload []byte, err error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:1]); err != nil {
+		return "", nil, err
+	}
+	a := make([]byte, n[0])
+	if _, err := io.ReadFull(r, a); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	payload = make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, unexpectedEOF(err)
+	}
+	return string(a), payload, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// relayPacketConn is a UDP session over a stream to the relay.
+type relayPacketConn struct {
+	net.Conn
+	r   *bufio.Reader
+	wmu sync.Mutex
+}
+
+func newRelayPacketConn(c net.Conn) *relayPacketConn {
+	return &relayPacketConn{Conn: c, r: bufio.NewReader(c)}
+}
+
+func (pc *relayPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	addr, payload, err := readUDPFrame(pc.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return 0, nil, fmt.Errorf("udp relay: bad source address %q", addr)
+	}
+	return copy(b, payload), net.UDPAddrFromAddrPort(ap), nil
+}
+
+func (pc *relayPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pc.wmu.Lock()
+	defer pc.wmu.Unlock()
+	if err := writeUDPFrame(pc.Conn, addr.String(), b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// udpRelay starts the relay pod on first use and connects to it over
+// port-forward streams.
+type udpRelay struct {
+	mu        sync.Mutex
+	client    kubernetes.Interface
+	namespace string
+	image     string
+	pod       *v1.Pod
+	backend   *backend
+	// starting is closed once the pod being started is ready or failed.
+	starting chan struct{}
+}
+
+// dial opens a stream for one UDP session.
+func (r *udpRelay) dial(ctx context.Context) (net.Conn, error) {
+	b, err := r.ensure(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 1; ; attempt++ {
+		f, err := forwardPod(b.pod)
+		if errors.Is(err, errForwardStopped) {
+			// the relay pod is gone, start a new one next time
+			r.mu.Lock()
+			r.pod, r.backend = nil, nil
+			r.mu.Unlock()
+		}
+		if err != nil {
+			return nil, err
+		}
+		c, err := dialBackend(f, b)
+		if errors.Is(err, errForwardStopped) && attempt < forwardDialAttempts {
+			// the forward was stopped meanwhile, set it up again
+			continue
+		}
+		return c, err
+	}
+}
+
+// podChanged forgets the relay pod once it is deleted, evicted or replaced,
+// so the next session starts a new one instead of retrying the gone pod.
+func (r *udpRelay) podChanged(pod *v1.Pod, deleted bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pod == nil || r.pod.Namespace != pod.Namespace || r.pod.Name != pod.Name {
+		return
+	}
+	if deleted || podGone(r.pod, pod) {
+		klog.Infof("udp relay pod %s/%s is gone", pod.Namespace, pod.Name)
+		r.pod, r.backend = nil, nil
+	}
+}
+
+// ensure starts the relay pod if it is not ready. Concurrent sessions wait
+// for the same pod without holding r.mu.
+func (r *udpRelay) ensure(ctx context.Context) (*backend, error) {
+	r.mu.Lock()
+	for r.backend == nil && r.starting != nil {
+		starting := r.starting
+		r.mu.Unlock()
+		select {
+		case <-starting:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		r.mu.Lock()
+	}
+	if r.backend != nil {
+		b := r.backend
+		r.mu.Unlock()
+		return b, nil
+	}
+	starting := make(chan struct{})
+	r.starting = starting
+	pod := r.pod
+	r.mu.Unlock()
+
+	var err error
+	if pod == nil {
+		pod, err = r.client.CoreV1().Pods(r.namespace).Create(ctx, relayPod(r.image), metav1.CreateOptions{})
+		if err == nil {
+			klog.Infof("created udp relay pod %s/%s", pod.Namespace, pod.Name)
+			r.mu.Lock()
+			r.pod = pod
+			r.mu.Unlock()
+		} else {
+			err = fmt.Errorf("failed to create udp relay pod: %w", err)
+		}
+	}
+	if err == nil {
+		pod, err = r.waitReady(ctx, pod)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.starting = nil
+	close(starting)
+	if err != nil {
+		return nil, err
+	}
+	if r.pod == nil || r.pod.Name != pod.Name {
+		return nil, errors.New("udp relay closed")
+	}
+	r.pod = pod
+	r.backend = &backend{pod: pod, port: udpRelayPort}
+	return r.backend, nil
+}
+
+// waitReady waits for the relay to pass its readiness probe, so the first
+// sessions do not race the listener.
+func (r *udpRelay) waitReady(ctx context.Context, pod *v1.Pod) (*v1.Pod, error) {
+	err := wait.PollUntilContextTimeout(ctx, time.Second, udpRelayStartTimeout, true, func(ctx context.Context) (bool, error) {
+		p, err := r.client.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		pod = p
+		switch pod.Status.Phase {
+		case v1.PodFailed, v1.PodSucceeded:
+			return false, fmt.Errorf("udp relay pod %s exited", pod.Name)
+		}
+		for _, c := range pod.Status.Conditions {
+			if c.Type == v1.PodReady {
+				return c.Status == v1.ConditionTrue, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("udp relay pod not ready: %w", err)
+	}
+	return pod, nil
+}
+
+// cleanup deletes the relays an earlier run on this host left behind, e.g.
+// after exiting on a fatal error.
+func (r *udpRelay) cleanup(ctx context.Context) {
+	pods, err := r.client.CoreV1().Pods(r.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: udpRelayLabel + "=" + udpRelayName + "," + udpRelayHostLabel + "=" + udpRelayHost(),
+	})
+	if err != nil {
+		klog.Warningf("failed to list stale udp relay pods: %v", err)
+		return
+	}
+	zero := int64(0)
+	for _, pod := range pods.Items {
+		err := r.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &zero})
+		if err != nil {
+			klog.Warningf("failed to delete stale udp relay pod %s: %v", pod.Name, err)
+			continue
+		}
+		klog.Infof("deleted stale udp relay pod %s/%s", pod.Namespace, pod.Name)
+	}
+}
+
+// close deletes the relay pod.
+func (r *udpRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pod == nil {
+		return
+	}
+	zero := int64(0)
+	err := r.client.CoreV1().Pods(r.pod.Namespace).Delete(context.TODO(), r.pod.Name, metav1.DeleteOptions{GracePeriodSeconds: &zero})
+	if err != nil {
+		klog.Warningf("failed to delete udp relay pod %s: %v", r.pod.Name, err)
+	}
+	r.pod, r.backend = nil, nil
+}
+
+func relayPod(image string) *v1.Pod {
+	nobody := int64(65534)
+	yes, no := true, false
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: udpRelayName + "-",
+			Labels: map[string]string{
+				udpRelayLabel:     udpRelayName,
+				udpRelayHostLabel: udpRelayHost(),
+			},
+		},
+		Spec: v1.PodSpec{
+			RestartPolicy:                v1.RestartPolicyNever,
+			AutomountServiceAccountToken: &no,
+			Containers: []v1.Container{{
+				Name:    "relay",
+				Image:   image,
+				Command: []string{"python3", "-u", "-c", udpRelayScript},
+				Ports:   []v1.ContainerPort{{ContainerPort: udpRelayPort, Protocol: v1.ProtocolTCP}},
+				ReadinessProbe: &v1.Probe{
+					ProbeHandler:  v1.ProbeHandler{Exec: &v1.ExecAction{Command: udpRelayReadyProbe}},
+					PeriodSeconds: 1,
+				},
+				SecurityContext: &v1.SecurityContext{
+					RunAsUser:                &nobody,
+					RunAsNonRoot:             &yes,
+					AllowPrivilegeEscalation: &no,
+					ReadOnlyRootFilesystem:   &yes,
+					Capabilities:             &v1.Capabilities{Drop: []v1.Capability{"ALL"}},
+				},
+			}},
+		},
+	}
+}
+
+// udpRelayHost identifies this host in relay pod labels. Hostnames do not
+// always make valid label values, so it is a hash.
+func udpRelayHost() string {
+	name, _ := os.Hostname()
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestUDPFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		addr    string
+		payload []byte
+	}{
+		{"10.96.0.10:53", []byte("query")},
+		{"[fd00:10:96::a]:8125", []byte("metric:1|c")},
+		{"10.0.0.1:514", nil},
+		{"10.0.0.1:443", bytes.Repeat([]byte{0xab}, 0xffff)},
+	}
+
+	var buf bytes.Buffer
+	for _, test := range tests {
+		if err := writeUDPFrame(&buf, test.addr, test.payload); err != nil {
+			t.Fatalf("writeUDPFrame(%s) error = %v", test.addr, err)
+		}
+	}
+	for _, test := range tests {
+		addr, payload, err := readUDPFrame(&buf)
+		if err != nil {
+			t.Fatalf("readUDPFrame() error = %v", err)
+		}
+		if addr != test.addr || !bytes.Equal(payload, test.payload) {
+			t.Errorf("readUDPFrame() = %s, %d bytes; want %s, %d bytes", addr, len(payload), test.addr, len(test.payload))
+		}
+	}
+	if _, _, err := readUDPFrame(&buf); !errors.Is(err, io.EOF) {
+		t.Errorf("readUDPFrame() at end error = %v; want EOF", err)
+	}
+}
+
+func TestUDPFrameErrors(t *testing.T) {
+	if err := writeUDPFrame(io.Discard, strings.Repeat("1", 256), nil); err == nil {
+		t.Errorf("writeUDPFrame() with a long address: expected error")
+	}
+	if err := writeUDPFrame(io.Discard, "10.0.0.1:53", make([]byte, 0x10000)); err == nil {
+		t.Errorf("writeUDPFrame() with a large datagram: expected error")
+	}
+
+	var buf bytes.Buffer
+	writeUDPFrame(&buf, "10.0.0.1:53", []byte("truncated"))
+	torn := bytes.NewReader(buf.Bytes()[:buf.Len()-3])
+	if _, _, err := readUDPFrame(torn); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("readUDPFrame() of a torn frame error = %v; want ErrUnexpectedEOF", err)
+	}
+}
+
+func TestRelayPacketConn(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	// the relay answers every datagram from the address it was sent to
+	go func() {
+		for {
+			addr, payload, err := readUDPFrame(remote)
+			if err != nil {
+				return
+			}
+			writeUDPFrame(remote, addr, append([]byte("re:"), payload...))
+		}
+	}()
+
+	pc := newRelayPacketConn(local)
+	dst := &net.UDPAddr{IP: net.ParseIP("fd00::53"), Port: 53}
+	if _, err := pc.WriteTo([]byte("ping"), dst); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom() error = %v", err)
+	}
+	if string(buf[:n]) != "re:ping" || from.String() != dst.String() {
+		t.Errorf("ReadFrom() = %q from %s; want re:ping from %s", buf[:n], from, dst)
+	}
+}
+
+// newTestRelay returns a relay whose pods get a name on creation and report
+// ready once ready is set.
+func newTestRelay(ready *atomic.Bool, objects ...runtime.Object) *udpRelay {
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*v1.Pod)
+		pod.Name = pod.GenerateName + "test"
+		return false, nil, nil
+	})
+	client.PrependReactor("get", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: action.(k8stesting.GetAction).GetName(), Namespace: action.GetNamespace()},
+			Status:     v1.PodStatus{Phase: v1.PodRunning},
+		}
+		status := v1.ConditionFalse
+		if ready.Load() {
+			status = v1.ConditionTrue
+		}
+		pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: status}}
+		return true, pod, nil
+	})
+	return &udpRelay{client: client, namespace: "default", image: "python:3-alpine"}
+}
+
+func TestUDPRelayWaitsForReady(t *testing.T) {
+	var ready atomic.Bool
+	r := newTestRelay(&ready)
+
+	// running is not enough, the listener may not be bound yet
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := r.ensure(ctx); err == nil {
+		t.Fatalf("ensure() with the relay not ready: expected error")
+	}
+
+	ready.Store(true)
+	b, err := r.ensure(context.Background())
+	if err != nil {
+		t.Fatalf("ensure() error = %v", err)
+	}
+	if b.pod.Name != udpRelayName+"-test" || b.port != udpRelayPort {
+		t.Errorf("ensure() = %s:%d", b.pod.Name, b.port)
+	}
+	pods, _ := r.client.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if len(pods.Items) != 1 {
+		t.Errorf("ensure() created %d pods; want 1", len(pods.Items))
+	}
+}
+
+func TestUDPRelayRestartsDeletedPod(t *testing.T) {
+	var ready atomic.Bool
+	ready.Store(true)
+	r := newTestRelay(&ready)
+	b, err := r.ensure(context.Background())
+	if err != nil {
+		t.Fatalf("ensure() error = %v", err)
+	}
+
+	// changes of other pods and of the running relay keep it
+	r.podChanged(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"}}, true)
+	r.podChanged(b.pod, false)
+	if got, err := r.ensure(context.Background()); err != nil || got != b {
+		t.Fatalf("ensure() = %v, %v; want the running relay", got, err)
+	}
+
+	// the relay pod is evicted and deleted
+	pods := r.client.CoreV1().Pods("default")
+	if err := pods.Delete(context.Background(), b.pod.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	r.podChanged(b.pod, true)
+	next, err := r.ensure(context.Background())
+	if err != nil {
+		t.Fatalf("ensure() after the relay pod is gone: %v", err)
+	}
+	if next == b {
+		t.Errorf("ensure() after the relay pod is gone returned the old relay")
+	}
+	if list, _ := pods.List(context.Background(), metav1.ListOptions{}); len(list.Items) != 1 {
+		t.Errorf("ensure() left %d relay pods; want a new one", len(list.Items))
+	}
+}
+
+func TestUDPRelayCleanup(t *testing.T) {
+	relay := func(name, host string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{udpRelayLabel: udpRelayName, udpRelayHostLabel: host},
+		}}
+	}
+	var ready atomic.Bool
+	r := newTestRelay(&ready, relay("stale", udpRelayHost()), relay("other", "elsewhere"))
+
+	r.cleanup(context.Background())
+	pods, _ := r.client.CoreV1().Pods("default").List(context.Background(), metav1.ListOptions{})
+	if len(pods.Items) != 1 || pods.Items[0].Name != "other" {
+		t.Errorf("pods after cleanup = %v; want only the other host's relay", pods.Items)
+	}
+}
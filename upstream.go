@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog"
+	"k8s.io/utils/clock"
+)
+
+const (
+	// dnsHealthInterval is how often the upstream resolvers are probed.
+	dnsHealthInterval = 10 * time.Second
+	// fallbackDNSUpstream is used when neither --dns-upstream nor the host
+	// name any resolver.
+	fallbackDNSUpstream = "1.1.1.1:53"
+)
+
+// hostResolvConfs are read in order for the host's resolvers. systemd-resolved
+// lists its real upstreams in the first, /etc/resolv.conf only points at its
+// stub listener.
+var hostResolvConfs = []string{"/run/systemd/resolve/resolv.conf", "/etc/resolv.conf"}
+
+// _dnsUpstreams resolves the names the cluster does not serve.
+var _dnsUpstreams = newDNSUpstreams([]string{fallbackDNSUpstream}, nil)
+
+// dnsServer is an upstream resolver. It is down after a failed exchange or
+// probe until it answers again.
+type dnsServer struct {
+	addr string
+	down atomic.Bool
+}
+
+// dnsRule sends the names under domain to servers.
+type dnsRule struct {
+	// domain is lower case and fully qualified.
+	domain  string
+	servers []*dnsServer
+}
+
+// dnsUpstreams are the resolvers for names outside the cluster: per-domain
+// rules, and the default servers for everything else.
+type dnsUpstreams struct {
+	pool    *dnsPool
+	clock   clock.WithTicker
+	servers []*dnsServer
+	// rules are ordered from the longest domain down, so the most specific
+	// one matches first.
+	rules []dnsRule
+}
+
+func newDNSUpstreams(servers []string, rules map[string][]string) *dnsUpstreams {
+	u := &dnsUpstreams{
+		pool:    _dnsPool,
+		clock:   clock.RealClock{},
+		servers: newDNSServers(servers),
+	}
+	for domain, servers := range rules {
+		u.rules = append(u.rules, dnsRule{domain: domain, servers: newDNSServers(servers)})
+	}
+	sort.Slice(u.rules, func(i, j int) bool {
+		return len(u.rules[i].domain) > len(u.rules[j].domain)
+	})
+	return u
+}
+
+func newDNSServers(addrs []string) []*dnsServer {
+	servers := make([]*dnsServer, 0, len(addrs))
+	for _, addr := range addrs {
+		servers = append(servers, &dnsServer{addr: addr})
+	}
+	return servers
+}
+
+// configureDNSUpstreams builds the upstreams from --dns-upstream and
+// --dns-forward. Without --dns-upstream the host's resolvers are used, so it
+// has to run before the host DNS is pointed at the proxy.
+func configureDNSUpstreams(opt *Opts) (*dnsUpstreams, error) {
+	var servers []string
+	for _, s := range opt.DNSUpstreams {
+		addr, err := parseDNSServer(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --dns-upstream: %w", err)
+		}
+		servers = append(servers, addr)
+	}
+	if len(servers) == 0 {
+		servers = hostDNSServers(dnsConfig(opt).Servers)
+		if len(servers) == 0 {
+			klog.Warningf("no host resolvers found, using %s, set them with --dns-upstream", fallbackDNSUpstream)
+			servers = []string{fallbackDNSUpstream}
+		}
+	}
+
+	rules := map[string][]string{}
+	for _, r := range opt.DNSForward {
+		domain, list, ok := strings.Cut(r, "=")
+		domain = strings.ToLower(dns.Fqdn(strings.TrimSpace(domain)))
+		if !ok || domain == "." || !zoneRe.MatchString(domain) {
+			return nil, fmt.Errorf("invalid --dns-forward %q, want domain=server[,server]", r)
+		}
+		for _, s := range strings.Split(list, ",") {
+			addr, err := parseDNSServer(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --dns-forward %q: %w", r, err)
+			}
+			rules[domain] = append(rules[domain], addr)
+		}
+	}
+
+	klog.Infof("DNS upstreams: %v", servers)
+	return newDNSUpstreams(servers, rules), nil
+}
+
+// parseDNSServer accepts an address with an optional port, 53 by default.
+func parseDNSServer(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return net.JoinHostPort(addr.String(), "53"), nil
+	}
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid dns server %q", s)
+	}
+	return addrPort.String(), nil
+}
+
+// hostDNSServers returns the nameservers of the first readable resolv.conf
+// in hostResolvConfs. The proxy's own addresses and the systemd-resolved
+// stub, which would send queries back to the proxy, are left out.
+func hostDNSServers(proxy []netip.Addr) []string {
+	for _, path := range hostResolvConfs {
+		cfg, err := dns.ClientConfigFromFile(path)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				klog.Warningf("failed to read %s: %v", path, err)
+			}
+			continue
+		}
+		var servers []string
+		for _, s := range cfg.Servers {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				continue
+			}
+			addr = addr.WithZone("")
+			if addr == netip.MustParseAddr("127.0.0.53") || containsAddr(proxy, addr) {
+				continue
+			}
+			servers = append(servers, net.JoinHostPort(addr.String(), cfg.Port))
+		}
+		return servers
+	}
+	return nil
+}
+
+func containsAddr(addrs []netip.Addr, addr netip.Addr) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the servers of the most specific rule for name.
+func (u *dnsUpstreams) match(name string) ([]*dnsServer, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	for _, r := range u.rules {
+		if dns.IsSubDomain(r.domain, name) {
+			return r.servers, true
+		}
+	}
+	return nil, false
+}
+
+// exchange sends req to the servers for its name, healthy ones first, and
+// fails over to the next on errors.
+func (u *dnsUpstreams) exchange(req *dns.Msg) (*dns.Msg, error) {
+	servers, ok := u.match(req.Question[0].Name)
+	if !ok {
+		servers = u.servers
+	}
+
+	var up, down []*dnsServer
+	for _, s := range servers {
+		if s.down.Load() {
+			down = append(down, s)
+		} else {
+			up = append(up, s)
+		}
+	}
+
+	var errs []error
+	for _, s := range append(up, down...) {
+		resp, err := u.pool.exchange(req, s.addr)
+		if err == nil {
+			u.markUp(s)
+			return resp, nil
+		}
+		u.markDown(s, err)
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (u *dnsUpstreams) markUp(s *dnsServer) {
+	if s.down.Swap(false) {
+		klog.Infof("DNS upstream %s is back", s.addr)
+	}
+}
+
+func (u *dnsUpstreams) markDown(s *dnsServer, err error) {
+	if !s.down.Swap(true) {
+		klog.Warningf("DNS upstream %s is down: %v", s.addr, err)
+	}
+}
+
+// checkHealth probes every server each interval until stop is closed, so a
+// failed server is used again once it answers and a dead one is skipped
+// before queries have to wait for it.
+func (u *dnsUpstreams) checkHealth(interval time.Duration, stop <-chan struct{}) {
+	ticker := u.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			u.probeAll()
+		}
+	}
+}
+
+func (u *dnsUpstreams) probeAll() {
+	servers := append([]*dnsServer(nil), u.servers...)
+	for _, r := range u.rules {
+		servers = append(servers, r.servers...)
+	}
+	for _, s := range servers {
+		req := new(dns.Msg)
+		req.SetQuestion(".", dns.TypeNS)
+		if _, err := u.pool.exchange(req, s.addr); err != nil {
+			u.markDown(s, err)
+		} else {
+			u.markUp(s)
+		}
+	}
+}
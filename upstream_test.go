@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	testingclock "k8s.io/utils/clock/testing"
+)
+
+// startTestDNSServer serves handler over UDP and TCP on one loopback port and
+// returns its address.
+func startTestDNSServer(t *testing.T, handler dns.Handler) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		t.Skipf("udp port %s taken: %v", ln.Addr(), err)
+	}
+	for _, server := range []*dns.Server{{Listener: ln, Handler: handler}, {PacketConn: pc, Handler: handler}} {
+		go server.ActivateAndServe()
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return ln.Addr().String()
+}
+
+// startTestUpstream serves a resolver on loopback that answers with an A
+// record of ip while healthy is true, and does not answer otherwise.
+func startTestUpstream(t *testing.T, ip string, healthy *atomic.Bool) string {
+	t.Helper()
+	return startTestDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if !healthy.Load() {
+			w.Close()
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 5 IN A " + ip)
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	}))
+}
+
+// newTestDNSPool is a pool giving up on unanswered UDP queries quickly.
+func newTestDNSPool() *dnsPool {
+	p := newDNSPool()
+	p.udp.Timeout = 200 * time.Millisecond
+	return p
+}
+
+// answerOf resolves name through u and returns the address it answered with.
+func answerOf(t *testing.T, u *dnsUpstreams, name string) string {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	resp, err := u.exchange(req)
+	if err != nil {
+		t.Fatalf("exchange(%s) error = %v", name, err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("exchange(%s) = %v; want one answer", name, resp.Answer)
+	}
+	return resp.Answer[0].(*dns.A).A.String()
+}
+
+func TestParseDNSServer(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"10.1.1.1", "10.1.1.1:53"},
+		{" 10.1.1.1:5353", "10.1.1.1:5353"},
+		{"fd00::53", "[fd00::53]:53"},
+		{"[fd00::53]:5353", "[fd00::53]:5353"},
+		{"dns.example.com", ""},
+		{"10.1.1.1:dns", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, err := parseDNSServer(test.in)
+		if got != test.want || (err != nil) != (test.want == "") {
+			t.Errorf("parseDNSServer(%q) = %q, %v; want %q", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestConfigureDNSUpstreams(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "resolv.conf")
+	err := os.WriteFile(conf, []byte("nameserver 127.0.0.53\nnameserver 127.0.0.1\nnameserver 192.168.1.1\nnameserver fd00::1\nsearch lan\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := hostResolvConfs
+	hostResolvConfs = []string{filepath.Join(t.TempDir(), "missing"), conf}
+	t.Cleanup(func() { hostResolvConfs = saved })
+
+	servers := func(u *dnsUpstreams) []string {
+		var addrs []string
+		for _, s := range u.servers {
+			addrs = append(addrs, s.addr)
+		}
+		return addrs
+	}
+
+	// the host resolvers, without the proxy and the systemd-resolved stub
+	u, err := configureDNSUpstreams(&Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := servers(u), []string{"192.168.1.1:53", "[fd00::1]:53"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("host upstreams = %q; want %q", got, want)
+	}
+
+	u, err = configureDNSUpstreams(&Opts{
+		DNSUpstreams: []string{"10.0.0.2", "10.0.0.3:5353"},
+		DNSForward:   []string{"corp.example.com=10.1.1.1,10.1.1.2", "Example.com.=10.2.2.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := servers(u), []string{"10.0.0.2:53", "10.0.0.3:5353"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("--dns-upstream upstreams = %q; want %q", got, want)
+	}
+	var rules []string
+	for _, r := range u.rules {
+		rules = append(rules, r.domain)
+	}
+	if want := []string{"corp.example.com.", "example.com."}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %q; want %q", rules, want)
+	}
+
+	// without any resolver the fallback is used
+	hostResolvConfs = nil
+	u, err = configureDNSUpstreams(&Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := servers(u), []string{fallbackDNSUpstream}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upstreams without resolvers = %q; want %q", got, want)
+	}
+
+	for _, bad := range []*Opts{
+		{DNSUpstreams: []string{"dns.example.com"}},
+		{DNSForward: []string{"corp.example.com"}},
+		{DNSForward: []string{"=10.1.1.1"}},
+		{DNSForward: []string{"corp.example.com=10.1.1.1,"}},
+		{DNSForward: []string{"corp_example!=10.1.1.1"}},
+	} {
+		if _, err := configureDNSUpstreams(bad); err == nil {
+			t.Errorf("configureDNSUpstreams(%+v): expected error", bad)
+		}
+	}
+}
+
+func TestDNSUpstreamsMatch(t *testing.T) {
+	u := newDNSUpstreams([]string{"10.0.0.2:53"}, map[string][]string{
+		"example.com.":      {"10.2.2.2:53"},
+		"corp.example.com.": {"10.1.1.1:53"},
+	})
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"corp.example.com.", "10.1.1.1:53"},
+		{"git.CORP.example.com", "10.1.1.1:53"},
+		{"www.example.com.", "10.2.2.2:53"},
+		{"notcorp.example.com.", "10.2.2.2:53"},
+		{"example.org.", ""},
+	}
+	for _, test := range tests {
+		servers, ok := u.match(test.name)
+		got := ""
+		if ok {
+			got = servers[0].addr
+		}
+		if got != test.want {
+			t.Errorf("match(%s) = %q; want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDNSUpstreamsFailover(t *testing.T) {
+	var firstUp, secondUp, corpUp atomic.Bool
+	secondUp.Store(true)
+	corpUp.Store(true)
+	first := startTestUpstream(t, "10.0.0.1", &firstUp)
+	second := startTestUpstream(t, "10.0.0.2", &secondUp)
+	corp := startTestUpstream(t, "10.1.1.1", &corpUp)
+
+	u := newDNSUpstreams([]string{first, second}, map[string][]string{"corp.example.com.": {corp}})
+	u.pool = newTestDNSPool()
+
+	if got := answerOf(t, u, "www.example.com."); got != "10.0.0.2" {
+		t.Errorf("answer with the first upstream down = %s; want 10.0.0.2", got)
+	}
+	if !u.servers[0].down.Load() || u.servers[1].down.Load() {
+		t.Errorf("down = %v, %v; want true, false", u.servers[0].down.Load(), u.servers[1].down.Load())
+	}
+	if got := answerOf(t, u, "git.corp.example.com."); got != "10.1.1.1" {
+		t.Errorf("answer for a forwarded domain = %s; want 10.1.1.1", got)
+	}
+
+	// a server marked down is still tried when nothing else answers
+	firstUp.Store(true)
+	secondUp.Store(false)
+	if got := answerOf(t, u, "www.example.com."); got != "10.0.0.1" {
+		t.Errorf("answer with only the down upstream answering = %s; want 10.0.0.1", got)
+	}
+	if u.servers[0].down.Load() || !u.servers[1].down.Load() {
+		t.Errorf("down = %v, %v; want false, true", u.servers[0].down.Load(), u.servers[1].down.Load())
+	}
+
+	firstUp.Store(false)
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	if _, err := u.exchange(req); err == nil {
+		t.Errorf("exchange() with all upstreams down: expected error")
+	}
+}
+
+func TestDNSUpstreamsCheckHealth(t *testing.T) {
+	var up atomic.Bool
+	addr := startTestUpstream(t, "10.0.0.1", &up)
+
+	u := newDNSUpstreams([]string{addr}, nil)
+	u.pool = newTestDNSPool()
+	clk := testingclock.NewFakeClock(time.Now())
+	u.clock = clk
+	stop := make(chan struct{})
+	defer close(stop)
+	go u.checkHealth(dnsHealthInterval, stop)
+
+	step := func() {
+		t.Helper()
+		waitFor(t, "the health check ticker", clk.HasWaiters)
+		clk.Step(dnsHealthInterval)
+	}
+
+	step()
+	waitFor(t, "the upstream to be marked down", u.servers[0].down.Load)
+
+	up.Store(true)
+	step()
+	waitFor(t, "the upstream to be marked up", func() bool { return !u.servers[0].down.Load() })
+}